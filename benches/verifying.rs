@@ -0,0 +1,142 @@
+use criterion::{criterion_group, criterion_main, BenchmarkId, Criterion};
+use post::{
+    config::Config,
+    metadata::PostMetadata,
+    verify::{verify_batch, verify_with_labels, VerifyConfig},
+    Proof,
+};
+use pprof::criterion::{Output, PProfProfiler};
+use rand::{thread_rng, RngCore};
+
+const CHALLENGE: &[u8; 32] = b"hello world, CHALLENGE me!!!!!!!";
+
+fn verify_bench(c: &mut Criterion) {
+    let mut group = c.benchmark_group("verifying");
+
+    let num_units = 4;
+    let labels_per_unit = 1024 * 1024;
+    let metadata = PostMetadata {
+        node_id: vec![],
+        commitment_atx_id: vec![],
+        bits_per_label: 8,
+        labels_per_unit,
+        num_units,
+        max_file_size: 4096 * 1024 * 1024,
+        nonce: None,
+        last_position: None,
+        checksums: None,
+    };
+    let k2 = 16 * 1024;
+    let cfg = Config {
+        labels_per_unit,
+        // every label block satisfies the difficulty so all of them are checked
+        k1: metadata.num_label_blocks() as u32,
+        k2,
+        k2_pow_difficulty: u64::MAX,
+        k3_pow_difficulty: u64::MAX,
+        b: 16,
+        n: 2,
+        ..Config::default()
+    };
+    let proof = Proof {
+        nonce: 0,
+        indicies: (0..k2 as u64).map(|i| i * 16).collect(),
+        k2_pow: 0,
+        k3_pow: 0,
+    };
+    let labels = (0..k2)
+        .map(|_| {
+            let mut block = [0u8; 16];
+            thread_rng().fill_bytes(&mut block);
+            block
+        })
+        .collect::<Vec<_>>();
+
+    for threads in [1, 2, 4, 8] {
+        let verify_cfg = VerifyConfig {
+            threads,
+            parallel_threshold: 0,
+            ..VerifyConfig::default()
+        };
+        group.bench_with_input(
+            BenchmarkId::new(format!("k2={k2}"), format!("threads={threads}")),
+            &verify_cfg,
+            |b, verify_cfg| {
+                b.iter(|| {
+                    verify_with_labels(CHALLENGE, &proof, &metadata, &cfg, &labels, verify_cfg)
+                })
+            },
+        );
+    }
+}
+
+fn verify_batch_bench(c: &mut Criterion) {
+    let mut group = c.benchmark_group("verifying batch");
+
+    let labels_per_unit = 1024 * 1024;
+    let metadata = PostMetadata {
+        node_id: vec![],
+        commitment_atx_id: vec![],
+        bits_per_label: 8,
+        labels_per_unit,
+        num_units: 4,
+        max_file_size: 4096 * 1024 * 1024,
+        nonce: None,
+        last_position: None,
+        checksums: None,
+    };
+    let k2 = 64;
+    let cfg = Config {
+        labels_per_unit,
+        k1: metadata.num_label_blocks() as u32,
+        k2,
+        k2_pow_difficulty: u64::MAX,
+        k3_pow_difficulty: u64::MAX,
+        b: 16,
+        n: 2,
+        ..Config::default()
+    };
+    // Proofs for the same nonce group share the k2 pow check and the AES cipher.
+    let proofs = (0..16)
+        .map(|i| Proof {
+            nonce: i % 2,
+            indicies: (0..k2 as u64).map(|j| j * 16 + i as u64).collect(),
+            k2_pow: 0,
+            k3_pow: 0,
+        })
+        .collect::<Vec<_>>();
+    let labels = (0..k2)
+        .map(|_| {
+            let mut block = [0u8; 16];
+            thread_rng().fill_bytes(&mut block);
+            block
+        })
+        .collect::<Vec<_>>();
+    let batch = proofs
+        .iter()
+        .map(|proof| (proof, labels.as_slice()))
+        .collect::<Vec<_>>();
+    let verify_cfg = VerifyConfig::default();
+
+    group.bench_function(BenchmarkId::new("proofs=16", "single"), |b| {
+        b.iter(|| {
+            proofs
+                .iter()
+                .map(|proof| {
+                    verify_with_labels(CHALLENGE, proof, &metadata, &cfg, &labels, &verify_cfg)
+                })
+                .collect::<Vec<_>>()
+        })
+    });
+    group.bench_function(BenchmarkId::new("proofs=16", "batch"), |b| {
+        b.iter(|| verify_batch(CHALLENGE, &batch, &metadata, &cfg, &verify_cfg))
+    });
+}
+
+criterion_group!(
+    name = benches;
+    config = Criterion::default().with_profiler(PProfProfiler::new(1000, Output::Flamegraph(None)));
+    targets=verify_bench, verify_batch_bench
+);
+
+criterion_main!(benches);
@@ -0,0 +1,171 @@
+//! Reporting errors of the C API.
+//!
+//! Functions that can fail return null (or another documented failure value)
+//! and record the error for the calling thread. The host then fetches it
+//! with [last_error_code] and [last_error_message]. A successful call clears it.
+
+use std::{
+    cell::RefCell,
+    ffi::{c_char, CString},
+    fmt, io, ptr,
+};
+
+use post::{
+    prove::{Cancelled, InvalidConfig, InvalidK2Pow},
+    reader::ReadError,
+};
+
+#[repr(C)]
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ErrorCode {
+    Ok = 0,
+    /// An argument passed to the function is invalid, e.g. a challenge of a wrong length
+    /// or a config that doesn't suit the POS data.
+    InvalidArgument = 1,
+    /// The metadata of the POS data can't be parsed.
+    InvalidMetadata = 2,
+    /// Reading the POS data or its metadata failed.
+    IoError = 3,
+    /// A proof of work doesn't satisfy its difficulty.
+    PowFailed = 4,
+    Cancelled = 5,
+    /// Anything else, including panics.
+    Internal = 6,
+}
+
+/// An argument passed through the C API is invalid.
+#[derive(Debug)]
+pub(crate) struct InvalidArgument(pub(crate) String);
+
+impl fmt::Display for InvalidArgument {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "invalid argument: {}", self.0)
+    }
+}
+
+impl std::error::Error for InvalidArgument {}
+
+thread_local! {
+    static LAST_ERROR: RefCell<Option<(ErrorCode, CString)>> = RefCell::new(None);
+}
+
+/// Find the error code for an error by the errors in its chain.
+pub(crate) fn error_code(err: &eyre::Report) -> ErrorCode {
+    if err.downcast_ref::<Cancelled>().is_some() {
+        return ErrorCode::Cancelled;
+    }
+    if err.downcast_ref::<InvalidK2Pow>().is_some() {
+        return ErrorCode::PowFailed;
+    }
+    if err.downcast_ref::<InvalidArgument>().is_some()
+        || err.downcast_ref::<InvalidConfig>().is_some()
+    {
+        return ErrorCode::InvalidArgument;
+    }
+    for cause in err.chain() {
+        if cause.is::<serde_json::Error>() {
+            return ErrorCode::InvalidMetadata;
+        }
+        if cause.is::<io::Error>() || cause.is::<ReadError>() {
+            return ErrorCode::IoError;
+        }
+    }
+    ErrorCode::Internal
+}
+
+pub(crate) fn set_last_error(code: ErrorCode, message: &str) {
+    // Messages can't contain NUL, replace any instead of losing the whole message.
+    let message = CString::new(message.replace('\0', " ")).expect("NULs replaced above");
+    LAST_ERROR.with(|last| *last.borrow_mut() = Some((code, message)));
+}
+
+pub(crate) fn clear_last_error() {
+    LAST_ERROR.with(|last| *last.borrow_mut() = None);
+}
+
+/// Code of the error of the last failed call on this thread,
+/// [ErrorCode::Ok] if the last call succeeded.
+#[no_mangle]
+pub extern "C" fn last_error_code() -> ErrorCode {
+    LAST_ERROR.with(|last| {
+        last.borrow()
+            .as_ref()
+            .map_or(ErrorCode::Ok, |(code, _)| *code)
+    })
+}
+
+/// Message of the error of the last failed call on this thread,
+/// null if the last call succeeded.
+///
+/// The message is owned by the library and valid until the next call on this thread,
+/// copy it to keep it. It must not be freed.
+#[no_mangle]
+pub extern "C" fn last_error_message() -> *const c_char {
+    LAST_ERROR.with(|last| {
+        last.borrow()
+            .as_ref()
+            .map_or(ptr::null(), |(_, message)| message.as_ptr())
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use std::{ffi::CStr, io};
+
+    use eyre::WrapErr;
+    use post::{
+        prove::{Cancelled, InvalidConfig, InvalidK2Pow},
+        reader::ReadError,
+    };
+
+    use super::{
+        clear_last_error, error_code, last_error_code, last_error_message, set_last_error,
+        ErrorCode, InvalidArgument,
+    };
+
+    #[test]
+    fn error_codes() {
+        let err = eyre::Report::new(InvalidArgument("challenge".to_string()));
+        assert_eq!(ErrorCode::InvalidArgument, error_code(&err));
+        let err = eyre::eyre!("k1 is too big")
+            .wrap_err(InvalidConfig)
+            .wrap_err("proving");
+        assert_eq!(ErrorCode::InvalidArgument, error_code(&err));
+
+        let err = serde_json::from_str::<u64>("{").wrap_err("loading metadata");
+        assert_eq!(ErrorCode::InvalidMetadata, error_code(&err.unwrap_err()));
+
+        let err = eyre::Report::new(io::Error::from(io::ErrorKind::NotFound)).wrap_err("reading");
+        assert_eq!(ErrorCode::IoError, error_code(&err));
+        let err = eyre::Report::new(ReadError::Corrupt { file: 1 });
+        assert_eq!(ErrorCode::IoError, error_code(&err));
+
+        let err = eyre::Report::new(InvalidK2Pow {
+            nonce_group: 0,
+            k2_pow: 1,
+        });
+        assert_eq!(ErrorCode::PowFailed, error_code(&err));
+
+        let err = eyre::Report::new(Cancelled).wrap_err("proving");
+        assert_eq!(ErrorCode::Cancelled, error_code(&err));
+
+        assert_eq!(ErrorCode::Internal, error_code(&eyre::eyre!("unexpected")));
+    }
+
+    #[test]
+    fn last_error() {
+        set_last_error(ErrorCode::IoError, "no\0data");
+        assert_eq!(ErrorCode::IoError, last_error_code());
+        let message = unsafe { CStr::from_ptr(last_error_message()) };
+        assert_eq!("no data", message.to_str().unwrap());
+
+        // The error is kept per thread.
+        std::thread::spawn(|| assert_eq!(ErrorCode::Ok, last_error_code()))
+            .join()
+            .unwrap();
+
+        clear_last_error();
+        assert_eq!(ErrorCode::Ok, last_error_code());
+        assert!(last_error_message().is_null());
+    }
+}
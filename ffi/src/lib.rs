@@ -1,12 +1,90 @@
 #![feature(vec_into_raw_parts)]
 
+pub mod error;
+pub mod logging;
+
 use std::{
     ffi::{c_char, c_uchar, CStr},
+    panic::{self, AssertUnwindSafe},
     path::Path,
+    sync::atomic::{AtomicBool, Ordering},
 };
 
-pub use post::config::Config;
-use post::prove;
+use error::InvalidArgument;
+
+use post::{config::OversizedFiles, prove};
+
+/// Values of [Config::on_oversized_file], see [OversizedFiles].
+pub const OVERSIZED_FILES_ERROR: u32 = 0;
+pub const OVERSIZED_FILES_TRUNCATE: u32 = 1;
+pub const OVERSIZED_FILES_IGNORE: u32 = 2;
+
+/// Configuration of proof generation, see [post::config::Config] for the meaning of the fields.
+///
+/// # ABI
+/// Since 0.2.0 the fields after `n` are part of the struct, so callers built against
+/// 0.1.0 must be rebuilt. Zero-initialize the struct and set the proving parameters
+/// to keep the defaults of the other options.
+#[repr(C)]
+#[derive(Debug, Default)]
+pub struct Config {
+    pub labels_per_unit: u64,
+    pub k1: u32,
+    pub k2: u32,
+    pub k2_pow_difficulty: u64,
+    pub k3_pow_difficulty: u64,
+    pub b: u32,
+    pub n: u32,
+    pub fast_proof_warning_ratio: f64,
+    /// One of the `OVERSIZED_FILES_*` values.
+    pub on_oversized_file: u32,
+    pub pause_load_average: f64,
+    pub resume_load_average: f64,
+    pub verify_checksums: bool,
+    pub read_batch_size: usize,
+    pub read_ahead: usize,
+    pub max_passes: u32,
+}
+
+// Changing the layout of the struct breaks the C ABI, bump the crate version and update
+// the ABI notes on [Config] along with this check.
+#[cfg(target_pointer_width = "64")]
+const _: () = assert!(std::mem::size_of::<Config>() == 104);
+
+impl TryFrom<Config> for post::config::Config {
+    type Error = InvalidArgument;
+
+    fn try_from(cfg: Config) -> Result<Self, Self::Error> {
+        // The enum isn't taken from C directly, an unknown value would be UB.
+        let on_oversized_file = match cfg.on_oversized_file {
+            OVERSIZED_FILES_ERROR => OversizedFiles::Error,
+            OVERSIZED_FILES_TRUNCATE => OversizedFiles::Truncate,
+            OVERSIZED_FILES_IGNORE => OversizedFiles::Ignore,
+            other => {
+                return Err(InvalidArgument(format!(
+                    "unknown oversized files policy {other}"
+                )))
+            }
+        };
+        Ok(Self {
+            labels_per_unit: cfg.labels_per_unit,
+            k1: cfg.k1,
+            k2: cfg.k2,
+            k2_pow_difficulty: cfg.k2_pow_difficulty,
+            k3_pow_difficulty: cfg.k3_pow_difficulty,
+            b: cfg.b,
+            n: cfg.n,
+            fast_proof_warning_ratio: cfg.fast_proof_warning_ratio,
+            on_oversized_file,
+            pause_load_average: cfg.pause_load_average,
+            resume_load_average: cfg.resume_load_average,
+            verify_checksums: cfg.verify_checksums,
+            read_batch_size: cfg.read_batch_size,
+            read_ahead: cfg.read_ahead,
+            max_passes: cfg.max_passes,
+        })
+    }
+}
 
 #[repr(C)]
 pub struct ArrayU64 {
@@ -33,6 +111,8 @@ pub unsafe extern "C" fn free_proof(proof: *mut Proof) {
 }
 
 /// Generate a proof
+///
+/// Returns null on failure, see [error::last_error_code] for why.
 #[no_mangle]
 pub extern "C" fn generate_proof(
     datadir: *const c_char,
@@ -40,30 +120,114 @@ pub extern "C" fn generate_proof(
     challenge_len: usize,
     cfg: Config,
 ) -> *mut Proof {
-    match _generate_proof(datadir, challenge, challenge_len, cfg) {
-        Ok(proof) => proof,
+    report_errors(|| _generate_proof(datadir, challenge, challenge_len, cfg, None))
+}
+
+/// Run `f`, recording its error or panic for [error::last_error_code].
+fn report_errors(f: impl FnOnce() -> eyre::Result<*mut Proof>) -> *mut Proof {
+    let result = panic::catch_unwind(AssertUnwindSafe(f)).unwrap_or_else(|panic| {
+        let msg = panic
+            .downcast_ref::<&str>()
+            .map(|s| s.to_string())
+            .or_else(|| panic.downcast_ref::<String>().cloned())
+            .unwrap_or_default();
+        Err(eyre::eyre!("panicked: {msg}"))
+    });
+    match result {
+        Ok(proof) => {
+            error::clear_last_error();
+            proof
+        }
         Err(e) => {
-            //TODO(brozansk) communicate errors better
-            eprintln!("{e:?}");
+            log::error!("{e:?}");
+            error::set_last_error(error::error_code(&e), &format!("{e:#}"));
             std::ptr::null_mut()
         }
     }
 }
 
+/// Handle to cancel a proof generation started with [generate_proof_cancellable].
+///
+/// It's created with [new_cancel_handle] and owned by the caller, who must free it
+/// with [free_cancel_handle] after the proof generation using it returned.
+pub struct CancelHandle {
+    stop: AtomicBool,
+}
+
+#[no_mangle]
+pub extern "C" fn new_cancel_handle() -> *mut CancelHandle {
+    Box::into_raw(Box::new(CancelHandle {
+        stop: AtomicBool::new(false),
+    }))
+}
+
+/// Make the proof generation using the handle stop. It can be called from any thread,
+/// the proof generation returns null soon after.
+///
+/// # Safety
+/// handle must be a pointer returned by [new_cancel_handle] that wasn't freed yet.
+#[no_mangle]
+pub unsafe extern "C" fn cancel_proof(handle: *const CancelHandle) {
+    (*handle).stop.store(true, Ordering::Relaxed);
+}
+
+/// Freeing a null handle does nothing.
+///
+/// # Safety
+/// handle must be null or a pointer returned by [new_cancel_handle] that wasn't freed yet
+/// and isn't used by a running proof generation.
+#[no_mangle]
+pub unsafe extern "C" fn free_cancel_handle(handle: *mut CancelHandle) {
+    if !handle.is_null() {
+        drop(Box::from_raw(handle));
+    }
+}
+
+/// Generate a proof that can be cancelled with [cancel_proof].
+/// Returns null if it fails or is cancelled, see [error::last_error_code] for which.
+///
+/// # Safety
+/// handle must be a pointer returned by [new_cancel_handle] and stay valid until this returns.
+/// A null handle fails with [error::ErrorCode::InvalidArgument].
+#[no_mangle]
+pub unsafe extern "C" fn generate_proof_cancellable(
+    datadir: *const c_char,
+    challenge: *const c_uchar,
+    challenge_len: usize,
+    cfg: Config,
+    handle: *const CancelHandle,
+) -> *mut Proof {
+    report_errors(|| {
+        let handle = handle
+            .as_ref()
+            .ok_or_else(|| InvalidArgument("cancel handle is null".to_string()))?;
+        _generate_proof(datadir, challenge, challenge_len, cfg, Some(&handle.stop))
+    })
+}
+
 fn _generate_proof(
     datadir: *const c_char,
     challenge: *const c_uchar,
     challenge_len: usize,
     cfg: Config,
+    stop: Option<&AtomicBool>,
 ) -> eyre::Result<*mut Proof> {
     let datadir = unsafe { CStr::from_ptr(datadir) };
-    let datadir = datadir.to_str().expect("Invalid UTF-8 string");
+    let datadir = datadir
+        .to_str()
+        .map_err(|_| InvalidArgument("datadir is not a valid UTF-8 string".to_string()))?;
     let datadir = Path::new(datadir);
 
     let challenge = unsafe { std::slice::from_raw_parts(challenge, challenge_len) };
-    let challenge = challenge.try_into()?;
+    let challenge = challenge
+        .try_into()
+        .map_err(|_| InvalidArgument(format!("challenge must be 32 bytes, got {challenge_len}")))?;
 
-    let proof = prove::generate_proof(datadir, challenge, cfg)?;
+    let cfg = post::config::Config::try_from(cfg)?;
+    let proof = match stop {
+        Some(stop) => prove::generate_proof_cancellable(datadir, challenge, cfg, stop)?,
+        None => prove::generate_proof(datadir, challenge, cfg)?,
+    };
 
     let (ptr, len, cap) = proof.indicies.into_raw_parts();
     let proof = Box::new(Proof {
@@ -75,3 +239,127 @@ fn _generate_proof(
 
     Ok(Box::into_raw(proof))
 }
+
+#[cfg(test)]
+mod tests {
+    use std::{
+        ffi::{CStr, CString},
+        fs,
+        path::Path,
+        ptr, thread,
+        time::Duration,
+    };
+
+    use tempfile::tempdir;
+
+    use crate::{
+        cancel_proof, error, free_cancel_handle, free_proof, generate_proof,
+        generate_proof_cancellable, new_cancel_handle, Config,
+    };
+
+    /// Write 4 units of 1024 8-bit labels of scrambled bytes with their metadata.
+    fn write_pos_data(datadir: &Path) {
+        let data: Vec<u8> = (0..4 * 1024u32)
+            .map(|i| (i.wrapping_mul(2654435761) >> 24) as u8)
+            .collect();
+        fs::write(datadir.join("postdata_0.bin"), data).unwrap();
+        let metadata = serde_json::json!({
+            "NodeId": "",
+            "CommitmentAtxId": "",
+            "BitsPerLabel": 8,
+            "LabelsPerUnit": 1024,
+            "NumUnits": 4,
+            "MaxFileSize": 4 * 1024,
+        });
+        fs::write(
+            datadir.join("postdata_metadata.json"),
+            serde_json::to_vec(&metadata).unwrap(),
+        )
+        .unwrap();
+    }
+
+    fn config() -> Config {
+        Config {
+            labels_per_unit: 1024,
+            k1: 10,
+            k2: 10,
+            k2_pow_difficulty: u64::MAX,
+            k3_pow_difficulty: u64::MAX,
+            b: 16,
+            n: 2,
+            ..Config::default()
+        }
+    }
+
+    #[test]
+    fn reporting_last_error() {
+        let datadir = tempdir().unwrap();
+        write_pos_data(datadir.path());
+        let datadir = CString::new(datadir.path().to_str().unwrap()).unwrap();
+        let challenge = [0u8; 32];
+
+        let proof = generate_proof(datadir.as_ptr(), challenge.as_ptr(), 31, config());
+        assert!(proof.is_null());
+        assert_eq!(error::ErrorCode::InvalidArgument, error::last_error_code());
+        let message = unsafe { CStr::from_ptr(error::last_error_message()) };
+        assert!(message
+            .to_str()
+            .unwrap()
+            .contains("challenge must be 32 bytes, got 31"));
+
+        // 4096 labels make 256 blocks, too few for k1.
+        let cfg = Config {
+            k1: 1000,
+            ..config()
+        };
+        let proof = generate_proof(datadir.as_ptr(), challenge.as_ptr(), 32, cfg);
+        assert!(proof.is_null());
+        assert_eq!(error::ErrorCode::InvalidArgument, error::last_error_code());
+
+        // Success clears the error.
+        let proof = generate_proof(datadir.as_ptr(), challenge.as_ptr(), 32, config());
+        assert!(!proof.is_null());
+        assert_eq!(error::ErrorCode::Ok, error::last_error_code());
+        assert!(error::last_error_message().is_null());
+        unsafe { free_proof(proof) };
+    }
+
+    #[test]
+    fn cancelling_running_proof() {
+        let datadir = tempdir().unwrap();
+        write_pos_data(datadir.path());
+        let datadir = CString::new(datadir.path().to_str().unwrap()).unwrap();
+        let challenge = [0u8; 32];
+        // No k2 pow satisfies the difficulty, proving never ends unless cancelled.
+        let cfg = Config {
+            k2_pow_difficulty: 0,
+            ..config()
+        };
+
+        let handle = new_cancel_handle();
+        let proof = thread::scope(|scope| {
+            let running = unsafe { &*handle };
+            scope.spawn(move || {
+                thread::sleep(Duration::from_millis(100));
+                unsafe { cancel_proof(running) };
+            });
+            unsafe {
+                generate_proof_cancellable(
+                    datadir.as_ptr(),
+                    challenge.as_ptr(),
+                    challenge.len(),
+                    cfg,
+                    handle,
+                )
+            }
+        });
+        assert!(proof.is_null());
+        assert_eq!(error::ErrorCode::Cancelled, error::last_error_code());
+        unsafe { free_cancel_handle(handle) };
+    }
+
+    #[test]
+    fn freeing_null_cancel_handle() {
+        unsafe { free_cancel_handle(ptr::null_mut()) };
+    }
+}
@@ -0,0 +1,184 @@
+//! Forwarding of the library logs to the host application.
+//!
+//! The host registers a callback with [set_log_callback]. Every log record
+//! emitted via the `log` crate (by this crate or by `post-rs`) is then passed
+//! to the callback as a level and a NUL-terminated message.
+//!
+//! # Threading
+//! The callback is invoked synchronously on whatever thread emitted the log,
+//! which might be a worker thread of the library. It must be thread-safe.
+//! The message pointer is only valid for the duration of the call.
+
+use std::{
+    ffi::{c_char, CString},
+    sync::{
+        atomic::{AtomicBool, Ordering},
+        Once, RwLock,
+    },
+};
+
+use log::{Level, LevelFilter, Log, Metadata, Record};
+
+/// Log level passed to the [LogCallback].
+/// Values match the `log` crate: lower is more severe.
+#[repr(C)]
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum LogLevel {
+    Error = 1,
+    Warn = 2,
+    Info = 3,
+    Debug = 4,
+    Trace = 5,
+}
+
+impl From<Level> for LogLevel {
+    fn from(level: Level) -> Self {
+        match level {
+            Level::Error => LogLevel::Error,
+            Level::Warn => LogLevel::Warn,
+            Level::Info => LogLevel::Info,
+            Level::Debug => LogLevel::Debug,
+            Level::Trace => LogLevel::Trace,
+        }
+    }
+}
+
+pub type LogCallback = extern "C" fn(level: LogLevel, message: *const c_char);
+
+static CALLBACK: RwLock<Option<LogCallback>> = RwLock::new(None);
+static LOGGER: CallbackLogger = CallbackLogger;
+static INIT: Once = Once::new();
+/// Whether [LOGGER] is the global logger, i.e. no other was installed before it.
+static INSTALLED: AtomicBool = AtomicBool::new(false);
+
+struct CallbackLogger;
+
+impl CallbackLogger {
+    fn callback(&self) -> Option<LogCallback> {
+        CALLBACK.read().ok().and_then(|cb| *cb)
+    }
+}
+
+impl Log for CallbackLogger {
+    fn enabled(&self, _: &Metadata) -> bool {
+        self.callback().is_some()
+    }
+
+    fn log(&self, record: &Record) {
+        if let Some(callback) = self.callback() {
+            // Interior NULs would truncate the message on the C side.
+            let message = record.args().to_string().replace('\0', "\\0");
+            if let Ok(message) = CString::new(message) {
+                callback(record.level().into(), message.as_ptr());
+            }
+        }
+    }
+
+    fn flush(&self) {}
+}
+
+/// Set a callback receiving the library logs.
+///
+/// Passing NULL disables log forwarding. The callback can be replaced
+/// at any time.
+///
+/// The global max level of the `log` crate is changed only if the forwarding logger
+/// got installed. If the process already had another logger, the callback is never called
+/// and that logger keeps its level.
+#[no_mangle]
+pub extern "C" fn set_log_callback(callback: Option<LogCallback>) {
+    INIT.call_once(|| {
+        // Fails only if the host process already installed another logger,
+        // which then gets the warning.
+        match log::set_logger(&LOGGER) {
+            Ok(()) => INSTALLED.store(true, Ordering::Relaxed),
+            Err(e) => log::warn!("failed to install log forwarding: {e}"),
+        }
+    });
+    *CALLBACK.write().unwrap_or_else(|e| e.into_inner()) = callback;
+    if INSTALLED.load(Ordering::Relaxed) {
+        log::set_max_level(match callback {
+            Some(_) => LevelFilter::Trace,
+            None => LevelFilter::Off,
+        });
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::{
+        ffi::{c_char, CStr},
+        sync::Mutex,
+    };
+
+    use log::Level;
+
+    use super::{set_log_callback, LogLevel};
+
+    /// Messages of this test, other tests log from other threads too.
+    const PREFIX: &str = "log bridge test: ";
+
+    static FIRST: Mutex<Vec<(LogLevel, String)>> = Mutex::new(Vec::new());
+    static SECOND: Mutex<Vec<(LogLevel, String)>> = Mutex::new(Vec::new());
+
+    fn record(records: &Mutex<Vec<(LogLevel, String)>>, level: LogLevel, message: *const c_char) {
+        let message = unsafe { CStr::from_ptr(message) }.to_str().unwrap();
+        if let Some(message) = message.strip_prefix(PREFIX) {
+            records.lock().unwrap().push((level, message.to_string()));
+        }
+    }
+
+    extern "C" fn first(level: LogLevel, message: *const c_char) {
+        record(&FIRST, level, message);
+    }
+
+    extern "C" fn second(level: LogLevel, message: *const c_char) {
+        record(&SECOND, level, message);
+    }
+
+    #[test]
+    fn level_mapping() {
+        assert_eq!(LogLevel::Error, Level::Error.into());
+        assert_eq!(LogLevel::Warn, Level::Warn.into());
+        assert_eq!(LogLevel::Info, Level::Info.into());
+        assert_eq!(LogLevel::Debug, Level::Debug.into());
+        assert_eq!(LogLevel::Trace, Level::Trace.into());
+    }
+
+    // The callback is global, so a single test sets, replaces and clears it.
+    #[test]
+    fn forwarding_logs() {
+        set_log_callback(Some(first));
+        log::error!("{PREFIX}error");
+        log::warn!("{PREFIX}warn");
+        log::info!("{PREFIX}info");
+        log::debug!("{PREFIX}debug");
+        log::trace!("{PREFIX}trace\0with NUL");
+        assert_eq!(
+            vec![
+                (LogLevel::Error, "error".to_string()),
+                (LogLevel::Warn, "warn".to_string()),
+                (LogLevel::Info, "info".to_string()),
+                (LogLevel::Debug, "debug".to_string()),
+                (LogLevel::Trace, "trace\\0with NUL".to_string()),
+            ],
+            *FIRST.lock().unwrap()
+        );
+
+        // Replacing the callback sends further logs to the new one only.
+        set_log_callback(Some(second));
+        log::info!("{PREFIX}replaced");
+        assert_eq!(5, FIRST.lock().unwrap().len());
+        assert_eq!(
+            vec![(LogLevel::Info, "replaced".to_string())],
+            *SECOND.lock().unwrap()
+        );
+
+        // Clearing it stops forwarding.
+        set_log_callback(None);
+        assert!(!log::log_enabled!(Level::Error));
+        log::error!("{PREFIX}cleared");
+        assert_eq!(5, FIRST.lock().unwrap().len());
+        assert_eq!(1, SECOND.lock().unwrap().len());
+    }
+}
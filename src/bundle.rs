@@ -0,0 +1,456 @@
+//! Self-contained files holding a [Proof] together with the [PostMetadata]
+//! of the data it was generated for.
+//!
+//! # format
+//! All integers are little-endian.
+//! - magic: `POSTBNDL`
+//! - version: u8
+//! - metadata: u32 length followed by the metadata JSON
+//! - proof: nonce (u32), k2_pow (u64), k3_pow (u64), number of indices (u32)
+//!   followed by the indices encoded as given by the version:
+//!   - 1: u64 each
+//!   - 2: the difference from the previous index (the first one from 0) as an LEB128 varint.
+//!     Indices in a proof are sorted and spread over the whole data, so for `k2` indices
+//!     into `N` label blocks every one takes about `log2(N / k2) / 7` bytes instead of 8.
+//!     For example, 37 indices into 2^30 blocks take 148 bytes instead of 296.
+//!   - 3: the number of bits of the largest index (u8), followed by every index in that many
+//!     bits, packed least significant bit first. For `N` label blocks no index takes more
+//!     than `log2(N)` bits, e.g. 37 indices into 2^30 blocks take 140 bytes.
+//!
+//! A proof can also be serialized alone with [Proof::to_bytes], as the version
+//! followed by the proof in the same format as above. Proofs serialized alone before
+//! versions were introduced (version 0) lack the version byte and store the indices
+//! as in version 1.
+
+use std::{fs, io::Read, path::Path};
+
+use eyre::Context;
+
+use crate::{
+    compression::{compress_indexes, decompress_indexes},
+    metadata::PostMetadata,
+    prove::Proof,
+};
+
+const MAGIC: &[u8; 8] = b"POSTBNDL";
+
+/// How the proof indices are stored in a bundle.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum IndexEncoding {
+    /// Every index as a u64 (bundle version 1).
+    FixedWidth,
+    /// Deltas between consecutive indices as varints (bundle version 2).
+    Varint,
+    /// Indices bit-packed to the width of the largest one (bundle version 3).
+    BitPacked,
+}
+
+impl IndexEncoding {
+    fn version(self) -> u8 {
+        match self {
+            IndexEncoding::FixedWidth => 1,
+            IndexEncoding::Varint => 2,
+            IndexEncoding::BitPacked => 3,
+        }
+    }
+
+    fn from_version(version: u8) -> Option<Self> {
+        match version {
+            1 => Some(IndexEncoding::FixedWidth),
+            2 => Some(IndexEncoding::Varint),
+            3 => Some(IndexEncoding::BitPacked),
+            _ => None,
+        }
+    }
+}
+
+impl Proof {
+    /// Write the proof along with the metadata to a bundle file,
+    /// using the compact [IndexEncoding::Varint] encoding.
+    pub fn write_bundle(&self, path: &Path, metadata: &PostMetadata) -> eyre::Result<()> {
+        self.write_bundle_with_encoding(path, metadata, IndexEncoding::Varint)
+    }
+
+    /// Write the proof along with the metadata to a bundle file,
+    /// choosing how the indices are encoded.
+    pub fn write_bundle_with_encoding(
+        &self,
+        path: &Path,
+        metadata: &PostMetadata,
+        encoding: IndexEncoding,
+    ) -> eyre::Result<()> {
+        let metadata = serde_json::to_vec(metadata).wrap_err("serializing metadata")?;
+
+        let mut bundle = Vec::with_capacity(MAGIC.len() + 1 + 4 + metadata.len() + 24);
+        bundle.extend_from_slice(MAGIC);
+        bundle.push(encoding.version());
+        bundle.extend_from_slice(&(metadata.len() as u32).to_le_bytes());
+        bundle.extend_from_slice(&metadata);
+        encode_proof(self, encoding, &mut bundle);
+
+        fs::write(path, bundle).wrap_err_with(|| format!("writing bundle to {}", path.display()))
+    }
+
+    /// Serialize the proof alone, prefixed with the version of its encoding.
+    pub fn to_bytes(&self, encoding: IndexEncoding) -> Vec<u8> {
+        let mut bytes = vec![encoding.version()];
+        encode_proof(self, encoding, &mut bytes);
+        bytes
+    }
+
+    /// Deserialize a proof serialized with [Proof::to_bytes] in any supported version.
+    ///
+    /// Unversioned proofs (version 0) are told apart by their length, `24 + 8 * count` bytes
+    /// for `count` indices. No versioned proof with fewer than 2^24 indices is that long.
+    pub fn from_bytes(bytes: &[u8]) -> eyre::Result<Proof> {
+        let mut reader = bytes;
+        if is_unversioned(bytes) {
+            return decode_proof(&mut reader, IndexEncoding::FixedWidth)
+                .wrap_err("parsing unversioned proof");
+        }
+        let encoding = read_encoding(&mut reader)?;
+        let proof = decode_proof(&mut reader, encoding).wrap_err("parsing proof")?;
+        eyre::ensure!(reader.is_empty(), "unexpected data after the proof");
+        Ok(proof)
+    }
+}
+
+/// Check if the bytes hold exactly a proof with every index as a u64, without a version.
+fn is_unversioned(bytes: &[u8]) -> bool {
+    let Some(count) = bytes.get(20..24) else {
+        return false;
+    };
+    let count = u32::from_le_bytes(count.try_into().expect("4 bytes"));
+    bytes.len() as u64 == 24 + 8 * count as u64
+}
+
+fn read_encoding(reader: &mut &[u8]) -> eyre::Result<IndexEncoding> {
+    let version = read_u8(reader).wrap_err("reading version")?;
+    IndexEncoding::from_version(version).ok_or_else(|| eyre::eyre!("unsupported version {version}"))
+}
+
+/// Read a proof and its metadata from a bundle file.
+pub fn read_bundle(path: &Path) -> eyre::Result<(Proof, PostMetadata)> {
+    let bundle =
+        fs::read(path).wrap_err_with(|| format!("reading bundle from {}", path.display()))?;
+    let mut reader = bundle.as_slice();
+
+    let mut magic = [0u8; MAGIC.len()];
+    reader.read_exact(&mut magic).wrap_err("reading magic")?;
+    eyre::ensure!(&magic == MAGIC, "not a proof bundle");
+
+    let encoding = read_encoding(&mut reader)?;
+
+    let len = read_u32(&mut reader).wrap_err("reading metadata length")? as usize;
+    eyre::ensure!(len <= reader.len(), "metadata is truncated");
+    let (metadata, mut reader) = reader.split_at(len);
+    let metadata = serde_json::from_slice(metadata).wrap_err("parsing metadata")?;
+
+    let proof = decode_proof(&mut reader, encoding).wrap_err("parsing proof")?;
+    eyre::ensure!(reader.is_empty(), "unexpected data after the proof");
+
+    Ok((proof, metadata))
+}
+
+fn encode_proof(proof: &Proof, encoding: IndexEncoding, out: &mut Vec<u8>) {
+    out.extend_from_slice(&proof.nonce.to_le_bytes());
+    out.extend_from_slice(&proof.k2_pow.to_le_bytes());
+    out.extend_from_slice(&proof.k3_pow.to_le_bytes());
+    out.extend_from_slice(&(proof.indicies.len() as u32).to_le_bytes());
+    match encoding {
+        IndexEncoding::FixedWidth => {
+            for index in &proof.indicies {
+                out.extend_from_slice(&index.to_le_bytes());
+            }
+        }
+        IndexEncoding::Varint => {
+            let mut previous = 0u64;
+            for &index in &proof.indicies {
+                // Wrapping keeps unsorted indices encodable, just not compactly.
+                write_varint(index.wrapping_sub(previous), out);
+                previous = index;
+            }
+        }
+        IndexEncoding::BitPacked => {
+            let bits = proof
+                .indicies
+                .iter()
+                .map(|index| u64::BITS - index.leading_zeros())
+                .max()
+                .unwrap_or(0)
+                .max(1) as usize;
+            out.push(bits as u8);
+            out.extend_from_slice(&compress_indexes(&proof.indicies, bits));
+        }
+    }
+}
+
+fn decode_proof(reader: &mut &[u8], encoding: IndexEncoding) -> eyre::Result<Proof> {
+    let nonce = read_u32(reader)?;
+    let k2_pow = read_u64(reader)?;
+    let k3_pow = read_u64(reader)?;
+    let count = read_u32(reader)? as usize;
+    // Every index takes at least 1 bit, don't allocate for more than there is.
+    eyre::ensure!(count <= reader.len() * 8, "indices are truncated");
+    let indicies = match encoding {
+        IndexEncoding::FixedWidth => (0..count)
+            .map(|_| read_u64(reader))
+            .collect::<eyre::Result<_>>()?,
+        IndexEncoding::Varint => {
+            let mut previous = 0u64;
+            (0..count)
+                .map(|_| {
+                    previous = previous.wrapping_add(read_varint(reader)?);
+                    Ok(previous)
+                })
+                .collect::<eyre::Result<_>>()?
+        }
+        IndexEncoding::BitPacked => {
+            let bits = read_u8(reader)? as usize;
+            eyre::ensure!((1..=64).contains(&bits), "invalid index width {bits}");
+            let len = (count * bits + 7) / 8;
+            eyre::ensure!(len <= reader.len(), "indices are truncated");
+            let (packed, rest) = reader.split_at(len);
+            *reader = rest;
+            // The last byte can be padded with enough bits for extra indices.
+            let mut indicies = decompress_indexes(packed, bits);
+            indicies.truncate(count);
+            indicies
+        }
+    };
+
+    Ok(Proof {
+        nonce,
+        indicies,
+        k2_pow,
+        k3_pow,
+    })
+}
+
+/// Write an LEB128 varint.
+fn write_varint(mut value: u64, out: &mut Vec<u8>) {
+    while value >= 0x80 {
+        out.push(value as u8 | 0x80);
+        value >>= 7;
+    }
+    out.push(value as u8);
+}
+
+/// Read an LEB128 varint.
+fn read_varint(reader: &mut &[u8]) -> eyre::Result<u64> {
+    let mut value = 0u64;
+    for shift in (0..64).step_by(7) {
+        let byte = read_u8(reader)?;
+        let bits = (byte & 0x7F) as u64;
+        eyre::ensure!(bits << shift >> shift == bits, "varint overflows u64");
+        value |= bits << shift;
+        if byte & 0x80 == 0 {
+            return Ok(value);
+        }
+    }
+    eyre::bail!("varint is too long")
+}
+
+fn read_u8(reader: &mut &[u8]) -> eyre::Result<u8> {
+    let mut buf = [0u8; 1];
+    reader.read_exact(&mut buf)?;
+    Ok(buf[0])
+}
+
+fn read_u32(reader: &mut &[u8]) -> eyre::Result<u32> {
+    let mut buf = [0u8; 4];
+    reader.read_exact(&mut buf)?;
+    Ok(u32::from_le_bytes(buf))
+}
+
+fn read_u64(reader: &mut &[u8]) -> eyre::Result<u64> {
+    let mut buf = [0u8; 8];
+    reader.read_exact(&mut buf)?;
+    Ok(u64::from_le_bytes(buf))
+}
+
+#[cfg(test)]
+mod tests {
+    use proptest::prelude::*;
+    use tempfile::tempdir;
+
+    use super::*;
+
+    fn metadata() -> PostMetadata {
+        PostMetadata {
+            node_id: vec![1; 32],
+            commitment_atx_id: vec![2; 32],
+            bits_per_label: 8,
+            labels_per_unit: 1024,
+            num_units: 4,
+            max_file_size: 4096,
+            nonce: Some(77),
+            last_position: None,
+            checksums: None,
+        }
+    }
+
+    fn proof() -> Proof {
+        Proof {
+            nonce: 5,
+            indicies: vec![1, 7, 100, 255],
+            k2_pow: 123,
+            k3_pow: u64::MAX,
+        }
+    }
+
+    #[test]
+    fn bundle_round_trip() {
+        let dir = tempdir().unwrap();
+        let path = dir.path().join("proof.bundle");
+        for encoding in [
+            IndexEncoding::FixedWidth,
+            IndexEncoding::Varint,
+            IndexEncoding::BitPacked,
+        ] {
+            proof()
+                .write_bundle_with_encoding(&path, &metadata(), encoding)
+                .unwrap();
+
+            let (read_proof, read_metadata) = read_bundle(&path).unwrap();
+            assert_eq!(proof(), read_proof);
+            assert_eq!(metadata(), read_metadata);
+        }
+    }
+
+    #[test]
+    fn proof_bytes_round_trip() {
+        let fixed = proof().to_bytes(IndexEncoding::FixedWidth);
+        let varint = proof().to_bytes(IndexEncoding::Varint);
+        assert_eq!(1, fixed[0]);
+        assert_eq!(2, varint[0]);
+        assert_eq!(proof(), Proof::from_bytes(&fixed).unwrap());
+        assert_eq!(proof(), Proof::from_bytes(&varint).unwrap());
+
+        // The indices are decoded as the version says.
+        let mut relabeled = varint.clone();
+        relabeled[0] = 1;
+        assert!(Proof::from_bytes(&relabeled).is_err());
+        let mut unknown = varint.clone();
+        unknown[0] = 0;
+        assert!(Proof::from_bytes(&unknown).is_err());
+
+        // Unversioned proofs are read as version 0.
+        let unversioned = &fixed[1..];
+        assert_eq!(proof(), Proof::from_bytes(unversioned).unwrap());
+        assert!(Proof::from_bytes(&unversioned[..unversioned.len() - 1]).is_err());
+        assert!(Proof::from_bytes(&[]).is_err());
+        assert!(Proof::from_bytes(&varint[..varint.len() - 1]).is_err());
+    }
+
+    #[test]
+    fn varint_encoding_is_compact() {
+        let proof = Proof {
+            nonce: 0,
+            indicies: (0..37).map(|i| i << 25).collect(),
+            k2_pow: 0,
+            k3_pow: 0,
+        };
+        let mut fixed = Vec::new();
+        encode_proof(&proof, IndexEncoding::FixedWidth, &mut fixed);
+        let mut compact = Vec::new();
+        encode_proof(&proof, IndexEncoding::Varint, &mut compact);
+        let mut packed = Vec::new();
+        encode_proof(&proof, IndexEncoding::BitPacked, &mut packed);
+        assert_eq!(24 + 37 * 8, fixed.len());
+        assert_eq!(24 + 1 + 36 * 4, compact.len());
+        // The largest index, 36 << 25, takes 31 bits.
+        assert_eq!(24 + 1 + (37 * 31 + 7) / 8, packed.len());
+    }
+
+    proptest! {
+        #[test]
+        fn varint_round_trip(indicies: Vec<u64>) {
+            let proof = Proof {
+                nonce: 1,
+                indicies,
+                k2_pow: 2,
+                k3_pow: 3,
+            };
+            let mut encoded = Vec::new();
+            encode_proof(&proof, IndexEncoding::Varint, &mut encoded);
+            let mut reader = encoded.as_slice();
+            let decoded = decode_proof(&mut reader, IndexEncoding::Varint).unwrap();
+            assert!(reader.is_empty());
+            assert_eq!(proof, decoded);
+        }
+    }
+
+    proptest! {
+        #[test]
+        fn bit_packed_round_trip(
+            (num_blocks, mut indicies) in (1..u64::MAX).prop_flat_map(|n| {
+                (Just(n), prop::collection::vec(0..n, 0..100))
+            })
+        ) {
+            indicies.sort_unstable();
+            let proof = Proof {
+                nonce: 1,
+                indicies,
+                k2_pow: 2,
+                k3_pow: 3,
+            };
+            let encoded = proof.to_bytes(IndexEncoding::BitPacked);
+            assert_eq!(proof, Proof::from_bytes(&encoded).unwrap());
+
+            // No index takes more bits than the number of blocks needs.
+            let bits = (u64::BITS - num_blocks.leading_zeros()) as usize;
+            let max_len = 1 + 24 + 1 + (proof.indicies.len() * bits + 7) / 8;
+            assert!(encoded.len() <= max_len);
+        }
+    }
+
+    #[test]
+    fn reject_invalid_bit_packing() {
+        let mut encoded = proof().to_bytes(IndexEncoding::BitPacked);
+        // After the version, nonce, pows and the number of indices.
+        let width_offset = 1 + 24;
+        for bits in [0, 65] {
+            encoded[width_offset] = bits;
+            assert!(Proof::from_bytes(&encoded).is_err());
+        }
+    }
+
+    #[test]
+    fn reject_invalid_varints() {
+        let too_long = [0xFF; 11];
+        assert!(read_varint(&mut too_long.as_slice()).is_err());
+        let overflowing = [0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x02];
+        assert!(read_varint(&mut overflowing.as_slice()).is_err());
+        let max = [0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x01];
+        assert_eq!(u64::MAX, read_varint(&mut max.as_slice()).unwrap());
+    }
+
+    #[test]
+    fn reject_invalid_bundles() {
+        let dir = tempdir().unwrap();
+        let path = dir.path().join("proof.bundle");
+        proof().write_bundle(&path, &metadata()).unwrap();
+        let valid = fs::read(&path).unwrap();
+
+        let mut bad_magic = valid.clone();
+        bad_magic[0] = b'X';
+        let mut bad_version = valid.clone();
+        bad_version[MAGIC.len()] = 0;
+        let mut trailing = valid.clone();
+        trailing.push(0);
+        let truncated = &valid[..valid.len() - 1];
+
+        let empty = &valid[..0];
+        for bundle in [
+            &bad_magic[..],
+            &bad_version[..],
+            &trailing[..],
+            truncated,
+            empty,
+        ] {
+            fs::write(&path, bundle).unwrap();
+            assert!(read_bundle(&path).is_err());
+        }
+    }
+}
@@ -4,6 +4,38 @@ use scrypt_jane::scrypt::ScryptParams;
 
 use crate::pow;
 
+/// Implementation of AES used to encrypt the labels.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum AesBackend {
+    /// AES instructions of the CPU (AES-NI).
+    Hardware,
+    /// Constant-time software implementation, many times slower.
+    Software,
+}
+
+/// The AES backend proving uses on this host.
+///
+/// The aes crate picks the backend at runtime, using the AES instructions when the CPU
+/// supports them and falling back to software otherwise. The software backend can be forced
+/// only when building, with `RUSTFLAGS="--cfg aes_force_soft"`, e.g. to benchmark it.
+/// There is no runtime switch: the crate doesn't expose its software implementation
+/// as a separate type, so the choice can't be made per [Config](crate::config::Config).
+pub fn aes_backend() -> AesBackend {
+    if cfg!(aes_force_soft) {
+        return AesBackend::Software;
+    }
+    #[cfg(any(target_arch = "x86", target_arch = "x86_64"))]
+    if std::arch::is_x86_feature_detected!("aes") && std::arch::is_x86_feature_detected!("sse2") {
+        return AesBackend::Hardware;
+    }
+    // The ARMv8 backend is used only if enabled with `--cfg aes_armv8`.
+    #[cfg(all(target_arch = "aarch64", aes_armv8))]
+    if std::arch::is_aarch64_feature_detected!("aes") {
+        return AesBackend::Hardware;
+    }
+    AesBackend::Software
+}
+
 #[derive(Debug)]
 pub(crate) struct AesCipher {
     pub(crate) aes: Aes128,
@@ -21,6 +53,12 @@ impl AesCipher {
         k2_pow_difficulty: u64,
     ) -> Self {
         let k2_pow = pow::find_k2_pow(challenge, nonce_group, params, k2_pow_difficulty);
+        Self::with_k2_pow(challenge, nonce_group, k2_pow)
+    }
+
+    /// Create new AES cipher for the given challenge and nonce
+    /// using an already known k2_pow.
+    pub(crate) fn with_k2_pow(challenge: &[u8; 32], nonce_group: u32, k2_pow: u64) -> Self {
         let mut hasher = blake3::Hasher::new();
         hasher.update(challenge);
         hasher.update(&nonce_group.to_le_bytes());
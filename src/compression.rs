@@ -1,6 +1,11 @@
 use bitvec::prelude::*;
 use bitvec::{slice::BitSlice, view::BitView};
 
+/// Number of bits required to store indexes up to `max_value`.
+pub(crate) fn required_bits(max_value: u64) -> usize {
+    (max_value as f64).log2() as usize + 1
+}
+
 pub(crate) fn compress_indexes(indexes: &[u64], keep_bits: usize) -> Vec<u8> {
     let mut bv = bitvec![u8, Lsb0;];
     for index in indexes {
@@ -9,7 +14,6 @@ pub(crate) fn compress_indexes(indexes: &[u64], keep_bits: usize) -> Vec<u8> {
     bv.as_raw_slice().to_owned()
 }
 
-#[allow(dead_code)]
 pub(crate) fn decompress_indexes(indexes: &[u8], bits: usize) -> Vec<u64> {
     BitSlice::<_, Lsb0>::from_slice(indexes)
         .chunks_exact(bits)
@@ -1,5 +1,8 @@
-#[repr(C)]
-#[derive(Debug)]
+/// Configuration of proof generation.
+///
+/// [Config::default] zeroes every field. The proving parameters must be set by the caller,
+/// the options default to their zero values documented on every field.
+#[derive(Debug, Default)]
 pub struct Config {
     pub labels_per_unit: u64,
     /// K1 specifies the difficulty for a label to be a candidate for a proof.
@@ -17,4 +20,49 @@ pub struct Config {
     pub b: u32,
     /// n is the number of nonces to try at the same time.
     pub n: u32,
+    /// Log a warning if a proof is found after reading less than this fraction
+    /// of the data expected to be needed. A proof found that quickly usually means
+    /// the difficulty is misconfigured. Set to 0 to disable the check.
+    pub fast_proof_warning_ratio: f64,
+    /// What to do with POS data files larger than the metadata declares.
+    pub on_oversized_file: OversizedFiles,
+    /// Pause proving while the 1-minute system load average is above this value,
+    /// to keep a shared machine responsive. Set to 0 to never pause.
+    pub pause_load_average: f64,
+    /// Resume paused proving once the load average drops below this value.
+    /// Set to 0 to resume below `pause_load_average`.
+    pub resume_load_average: f64,
+    /// Check the POS data files against the checksums in the metadata as they're read
+    /// when proving. The first pass over the data then reads all of it, even if a proof
+    /// is found early. Datasets without checksums are not checked.
+    pub verify_checksums: bool,
+    /// Size in bytes of the reads of the POS data when proving, rounded up to a multiple
+    /// of 128. Larger reads help on high-latency storage like network mounts.
+    /// Set to 0 for the default of 1 MiB.
+    ///
+    /// The default doesn't depend on the storage type, which can't be told portably.
+    /// Use [measure_read_throughput](crate::reader::measure_read_throughput) to pick a size.
+    pub read_batch_size: usize,
+    /// Number of reads to do ahead on a separate thread while the data already read
+    /// is searched. Set to 0 to read on the proving thread.
+    pub read_ahead: usize,
+    /// Fail after this many passes over the data without finding a proof,
+    /// e.g. because the parameters make it unlikely. Set to 0 to never give up.
+    pub max_passes: u32,
+}
+
+/// Handling of POS data files larger than the metadata declares,
+/// e.g. because of leftovers from an earlier initialization.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Default)]
+pub enum OversizedFiles {
+    /// Refuse to prove.
+    #[default]
+    Error,
+    /// Read only as many bytes of every file as the metadata declares.
+    Truncate,
+    /// Read whole files.
+    ///
+    /// Risky: extra data shifts the position of all labels in the following files,
+    /// so proofs generated from them fail verification.
+    Ignore,
 }
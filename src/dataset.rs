@@ -0,0 +1,297 @@
+//! Checking that POS data is consistent with its metadata.
+//!
+//! Labels can't be recomputed without the initializer, so only the layout
+//! of the data and the optional checksums of a sample of the files are checked.
+
+use std::{
+    collections::hash_map::RandomState,
+    hash::{BuildHasher, Hasher},
+    path::Path,
+};
+
+use eyre::Context;
+
+use crate::{
+    metadata::{self, PostMetadata},
+    reader::{expected_file_size, file_checksum, pos_files},
+};
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum DatasetProblem {
+    /// The metadata doesn't describe a valid dataset.
+    InvalidMetadata(String),
+    MissingFile {
+        file: usize,
+    },
+    /// A file past the last one expected for the metadata.
+    UnexpectedFile {
+        file: usize,
+    },
+    FileSizeMismatch {
+        file: usize,
+        expected: u64,
+        got: u64,
+    },
+    /// The file doesn't match its checksum from the metadata.
+    Corrupt {
+        file: usize,
+    },
+}
+
+/// Problems found in a dataset, empty if it's valid.
+#[derive(Debug, Default, Clone, PartialEq, Eq)]
+pub struct DatasetReport {
+    pub problems: Vec<DatasetProblem>,
+}
+
+impl DatasetReport {
+    pub fn is_valid(&self) -> bool {
+        self.problems.is_empty()
+    }
+}
+
+/// Check the POS data in `datadir` against its metadata.
+///
+/// The sizes of all files are checked, but only the `sample_rate` fraction of them,
+/// at least one, is read to be checked against its checksum. The files are sampled
+/// at random on every call, so running it periodically covers all of them over time.
+/// Use 1 to check every file.
+///
+/// Fails only if the metadata can't be loaded or the files can't be read,
+/// everything else is reported in the [DatasetReport].
+pub fn validate_dataset(datadir: &Path, sample_rate: f64) -> eyre::Result<DatasetReport> {
+    let seed = RandomState::new().build_hasher().finish();
+    validate_sampled_dataset(datadir, sample_rate, seed)
+}
+
+/// Like [validate_dataset], but the files to check are sampled by the `seed`.
+fn validate_sampled_dataset(
+    datadir: &Path,
+    sample_rate: f64,
+    seed: u64,
+) -> eyre::Result<DatasetReport> {
+    eyre::ensure!(
+        sample_rate > 0.0 && sample_rate <= 1.0,
+        "sample rate must be in (0, 1], got {sample_rate}"
+    );
+    let metadata = metadata::load(datadir).wrap_err("loading metadata")?;
+    let mut report = DatasetReport {
+        problems: metadata_problems(&metadata),
+    };
+    if !report.is_valid() {
+        return Ok(report);
+    }
+
+    let expected_files = metadata.expected_file_count()?;
+    let mut sizes = vec![None; expected_files];
+    for (file, entry) in pos_files(datadir) {
+        let len = entry
+            .metadata()
+            .wrap_err_with(|| format!("reading metadata of {:?}", entry.path()))?
+            .len();
+        match sizes.get_mut(file) {
+            Some(size) => *size = Some(len),
+            None => report
+                .problems
+                .push(DatasetProblem::UnexpectedFile { file }),
+        }
+    }
+    for (file, size) in sizes.iter().enumerate() {
+        let expected = expected_file_size(file, &metadata);
+        match *size {
+            None => report.problems.push(DatasetProblem::MissingFile { file }),
+            Some(got) if got != expected => {
+                report.problems.push(DatasetProblem::FileSizeMismatch {
+                    file,
+                    expected,
+                    got,
+                })
+            }
+            Some(_) => {}
+        }
+    }
+
+    if let Some(checksums) = &metadata.checksums {
+        if checksums.len() != expected_files {
+            report
+                .problems
+                .push(DatasetProblem::InvalidMetadata(format!(
+                    "{} checksums for {expected_files} files",
+                    checksums.len()
+                )));
+        }
+        for file in sample_files(checksums.len(), sample_rate, seed) {
+            if sizes.get(file).copied().flatten().is_none() {
+                continue;
+            }
+            let checksum = &checksums[file];
+            let path = datadir.join(format!("postdata_{file}.bin"));
+            let actual = file_checksum(&path).wrap_err_with(|| format!("reading {path:?}"))?;
+            if &actual != checksum {
+                report.problems.push(DatasetProblem::Corrupt { file });
+            }
+        }
+    }
+
+    Ok(report)
+}
+
+/// Pick `sample_rate` of the `files`, at least one, at random by the `seed`.
+/// Returns the indices of the picked files in order.
+fn sample_files(files: usize, sample_rate: f64, seed: u64) -> Vec<usize> {
+    let count = (files as f64 * sample_rate).ceil() as usize;
+    let mut sampled: Vec<usize> = (0..files).collect();
+    sampled.sort_by_cached_key(|&file| {
+        let mut hasher = blake3::Hasher::new();
+        hasher.update(&seed.to_le_bytes());
+        hasher.update(&(file as u64).to_le_bytes());
+        *hasher.finalize().as_bytes()
+    });
+    sampled.truncate(count.max(1));
+    sampled.sort_unstable();
+    sampled
+}
+
+fn metadata_problems(metadata: &PostMetadata) -> Vec<DatasetProblem> {
+    let mut problems = Vec::new();
+    let mut check = |valid: bool, msg: &str| {
+        if !valid {
+            problems.push(DatasetProblem::InvalidMetadata(msg.to_string()));
+        }
+    };
+    check(metadata.bits_per_label > 0, "bits per label must be > 0");
+    check(metadata.labels_per_unit > 0, "labels per unit must be > 0");
+    check(metadata.num_units > 0, "number of units must be > 0");
+    check(metadata.max_file_size > 0, "max file size must be > 0");
+    problems
+}
+
+#[cfg(test)]
+mod tests {
+    use std::fs;
+
+    use tempfile::tempdir;
+
+    use super::*;
+    use crate::reader::compute_checksums;
+
+    fn write_metadata(datadir: &Path, metadata: &PostMetadata) {
+        let file = fs::File::create(datadir.join("postdata_metadata.json")).unwrap();
+        serde_json::to_writer(file, metadata).unwrap();
+    }
+
+    fn metadata() -> PostMetadata {
+        PostMetadata {
+            node_id: vec![0; 32],
+            commitment_atx_id: vec![0; 32],
+            bits_per_label: 8,
+            labels_per_unit: 64,
+            num_units: 2,
+            max_file_size: 48,
+            nonce: None,
+            last_position: None,
+            checksums: None,
+        }
+    }
+
+    #[test]
+    fn validating_dataset() {
+        let datadir = tempdir().unwrap();
+        // 128 bytes of data in files of 48, 48 and 32 bytes
+        for (file, size) in [48, 48, 32].into_iter().enumerate() {
+            fs::write(
+                datadir.path().join(format!("postdata_{file}.bin")),
+                vec![file as u8; size],
+            )
+            .unwrap();
+        }
+        let mut metadata = metadata();
+        metadata.checksums = Some(compute_checksums(datadir.path()).unwrap());
+        write_metadata(datadir.path(), &metadata);
+        assert_eq!(
+            DatasetReport::default(),
+            validate_dataset(datadir.path(), 1.0).unwrap()
+        );
+
+        fs::write(datadir.path().join("postdata_0.bin"), [9; 48]).unwrap();
+        fs::write(datadir.path().join("postdata_1.bin"), [1; 40]).unwrap();
+        fs::remove_file(datadir.path().join("postdata_2.bin")).unwrap();
+        fs::write(datadir.path().join("postdata_3.bin"), [3; 8]).unwrap();
+        let report = validate_dataset(datadir.path(), 1.0).unwrap();
+        assert_eq!(
+            vec![
+                DatasetProblem::UnexpectedFile { file: 3 },
+                DatasetProblem::FileSizeMismatch {
+                    file: 1,
+                    expected: 48,
+                    got: 40
+                },
+                DatasetProblem::MissingFile { file: 2 },
+                DatasetProblem::Corrupt { file: 0 },
+                DatasetProblem::Corrupt { file: 1 },
+            ],
+            report.problems
+        );
+    }
+
+    #[test]
+    fn sampling_files_to_check() {
+        let datadir = tempdir().unwrap();
+        for (file, size) in [48, 48, 32].into_iter().enumerate() {
+            fs::write(
+                datadir.path().join(format!("postdata_{file}.bin")),
+                vec![file as u8; size],
+            )
+            .unwrap();
+        }
+        let mut metadata = metadata();
+        metadata.checksums = Some(compute_checksums(datadir.path()).unwrap());
+        write_metadata(datadir.path(), &metadata);
+
+        // Every file is corrupt, only the sampled ones are caught.
+        for file in 0..3 {
+            let path = datadir.path().join(format!("postdata_{file}.bin"));
+            let mut data = fs::read(&path).unwrap();
+            data[0] ^= 0xFF;
+            fs::write(path, data).unwrap();
+        }
+        for seed in 0..4 {
+            let sampled = sample_files(3, 0.5, seed);
+            assert_eq!(2, sampled.len());
+            let report = validate_sampled_dataset(datadir.path(), 0.5, seed).unwrap();
+            assert_eq!(
+                sampled
+                    .into_iter()
+                    .map(|file| DatasetProblem::Corrupt { file })
+                    .collect::<Vec<_>>(),
+                report.problems
+            );
+        }
+        assert_eq!(vec![0, 1, 2], sample_files(3, 1.0, 0));
+        assert_eq!(1, sample_files(3, 0.01, 0).len());
+
+        assert!(validate_dataset(datadir.path(), 0.0).is_err());
+        assert!(validate_dataset(datadir.path(), 1.5).is_err());
+    }
+
+    #[test]
+    fn invalid_metadata() {
+        let datadir = tempdir().unwrap();
+        write_metadata(
+            datadir.path(),
+            &PostMetadata {
+                max_file_size: 0,
+                ..metadata()
+            },
+        );
+        let report = validate_dataset(datadir.path(), 1.0).unwrap();
+        assert_eq!(
+            vec![DatasetProblem::InvalidMetadata(
+                "max file size must be > 0".to_string()
+            )],
+            report.problems
+        );
+
+        assert!(validate_dataset(&datadir.path().join("missing"), 1.0).is_err());
+    }
+}
@@ -0,0 +1,94 @@
+//! Estimating proofs before generating them, e.g. to tune the proving parameters.
+//!
+//! Every block of `b` labels satisfies the proving difficulty for a nonce with the probability
+//! of `k1 / num_blocks`, so the number of indices found for a nonce in a pass over the data
+//! follows a binomial distribution. With many blocks it's approximated by a Poisson
+//! distribution with the mean of `k1`.
+
+/// Expected properties of a proof for the given parameters.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct ProofEstimate {
+    /// Mean number of indices satisfying the difficulty for a single nonce over the whole data.
+    pub expected_indices: f64,
+    /// Size of the proof serialized with [Proof::to_bytes](crate::prove::Proof::to_bytes)
+    /// using [IndexEncoding::FixedWidth](crate::bundle::IndexEncoding::FixedWidth):
+    /// the version, the nonce, the k2 and k3 pows, the number of indices and `k2` indices.
+    /// The compact encodings take less, depending on the indices found.
+    pub serialized_bytes: usize,
+    /// Probability that a single nonce finds at least `k2` indices in a pass over the data.
+    pub success_probability: f64,
+}
+
+/// Estimate a proof over `num_labels` labels, with `b` labels per block.
+pub fn estimate_proof(num_labels: u64, b: u32, k1: u32, k2: u32) -> eyre::Result<ProofEstimate> {
+    eyre::ensure!(b > 0, "b must be > 0");
+    let num_blocks = num_labels / b as u64;
+    eyre::ensure!(num_blocks > 0, "number of label blocks must be > 0");
+    eyre::ensure!(
+        num_blocks >= k1 as u64,
+        "k1 ({k1}) cannot be bigger than the number of label blocks ({num_blocks})"
+    );
+
+    Ok(ProofEstimate {
+        expected_indices: k1 as f64,
+        serialized_bytes: 1 + 4 + 8 + 8 + 4 + 8 * k2 as usize,
+        success_probability: poisson_at_least(k1 as f64, k2),
+    })
+}
+
+/// P(X >= k) for X ~ Poisson(mean).
+fn poisson_at_least(mean: f64, k: u32) -> f64 {
+    if mean == 0.0 {
+        return if k == 0 { 1.0 } else { 0.0 };
+    }
+    // Sum P(X = i) for i < k in log space, as e^-mean underflows for large means.
+    let mut ln_p = -mean;
+    let mut below = 0.0;
+    for i in 0..k {
+        if i > 0 {
+            ln_p += mean.ln() - (i as f64).ln();
+        }
+        below += ln_p.exp();
+    }
+    (1.0 - below).clamp(0.0, 1.0)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::{estimate_proof, poisson_at_least};
+    use crate::{bundle::IndexEncoding, prove::Proof};
+
+    #[test]
+    fn estimating_proof() {
+        let estimate = estimate_proof(16 * 1024, 16, 8, 8).unwrap();
+        assert_eq!(8.0, estimate.expected_indices);
+        let proof = Proof {
+            nonce: 1,
+            indicies: (0..8).map(|i| i * 100).collect(),
+            k2_pow: 2,
+            k3_pow: 3,
+        };
+        assert_eq!(
+            proof.to_bytes(IndexEncoding::FixedWidth).len(),
+            estimate.serialized_bytes
+        );
+
+        // Harder proofs are less likely.
+        let easier = estimate_proof(16 * 1024, 16, 8, 4).unwrap();
+        assert!(easier.success_probability > estimate.success_probability);
+
+        assert!(estimate_proof(16 * 1024, 16, 2048, 8).is_err());
+        assert!(estimate_proof(8, 16, 1, 1).is_err());
+        assert!(estimate_proof(16, 0, 1, 1).is_err());
+    }
+
+    #[test]
+    fn poisson_tail() {
+        assert_eq!(1.0, poisson_at_least(2.0, 0));
+        assert!((poisson_at_least(2.0, 1) - (1.0 - (-2.0f64).exp())).abs() < 1e-12);
+        // A large mean doesn't underflow, P(X >= mean) is about a half.
+        let p = poisson_at_least(10_000.0, 10_000);
+        assert!(p > 0.49 && p < 0.51, "{p}");
+        assert_eq!(0.0, poisson_at_least(0.0, 1));
+    }
+}
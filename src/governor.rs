@@ -0,0 +1,83 @@
+//! Pausing proving while the machine is busy.
+//!
+//! Enabled by setting [Config::pause_load_average](crate::config::Config::pause_load_average).
+//! Proving pauses between batches of data, so no in-flight work is lost.
+
+use std::{thread, time::Duration};
+
+const POLL_INTERVAL: Duration = Duration::from_secs(5);
+
+/// Block while the system is too busy to prove.
+///
+/// Returns immediately if the 1-minute load average is at most `pause`.
+/// Otherwise waits until it drops below `resume`, or below `pause` if `resume` is not positive,
+/// e.g. left zeroed by a caller that set only `pause`.
+pub(crate) fn wait_for_low_load(pause: f64, resume: f64) {
+    wait_for_low_load_with(pause, resume, POLL_INTERVAL, load_average);
+}
+
+fn wait_for_low_load_with<L>(pause: f64, resume: f64, poll: Duration, mut load: L)
+where
+    L: FnMut() -> Option<f64>,
+{
+    // A zero resume threshold could never be reached.
+    let resume = if resume > 0.0 { resume } else { pause };
+    let Some(current) = load().filter(|&l| l > pause) else {
+        return;
+    };
+    log::info!("pausing proving, load average {current:.2} is above {pause:.2}");
+    loop {
+        thread::sleep(poll);
+        match load() {
+            Some(current) if current >= resume => {}
+            Some(current) => {
+                log::info!("resuming proving, load average {current:.2} is below {resume:.2}");
+                return;
+            }
+            None => {
+                log::info!("resuming proving, load average is unavailable");
+                return;
+            }
+        }
+    }
+}
+
+/// The 1-minute load average, if the platform provides it.
+#[cfg(target_os = "linux")]
+fn load_average() -> Option<f64> {
+    let loadavg = std::fs::read_to_string("/proc/loadavg").ok()?;
+    loadavg.split_whitespace().next()?.parse().ok()
+}
+
+#[cfg(not(target_os = "linux"))]
+fn load_average() -> Option<f64> {
+    None
+}
+
+#[cfg(test)]
+mod tests {
+    use std::time::Duration;
+
+    use super::wait_for_low_load_with;
+
+    #[test]
+    fn pause_until_load_drops() {
+        let mut loads = [3.0, 2.5, 1.9, 1.0].into_iter();
+        wait_for_low_load_with(2.0, 2.0, Duration::ZERO, || loads.next());
+        assert_eq!(Some(1.0), loads.next());
+
+        // don't pause below the threshold
+        let mut loads = [2.0, 3.0].into_iter();
+        wait_for_low_load_with(2.0, 1.0, Duration::ZERO, || loads.next());
+        assert_eq!(Some(3.0), loads.next());
+
+        // resume below the pause threshold if the resume one isn't set
+        let mut loads = [3.0, 2.5, 1.9, 1.0].into_iter();
+        wait_for_low_load_with(2.0, 0.0, Duration::ZERO, || loads.next());
+        assert_eq!(Some(1.0), loads.next());
+
+        // resume if the load can't be read anymore
+        let mut loads = [3.0].into_iter();
+        wait_for_low_load_with(2.0, 1.0, Duration::ZERO, || loads.next());
+    }
+}
@@ -1,10 +1,14 @@
-mod cipher;
+pub mod bundle;
+pub mod cipher;
 mod compression;
 pub mod config;
+pub mod dataset;
 mod difficulty;
-mod metadata;
+pub mod estimate;
+mod governor;
+pub mod metadata;
 pub mod pow;
 pub mod prove;
 pub mod reader;
-mod verify;
+pub mod verify;
 pub use crate::prove::*;
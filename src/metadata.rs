@@ -1,13 +1,16 @@
 use std::{fs::File, io::BufReader, path::Path};
 
-use serde::Deserialize;
+use serde::{Deserialize, Serialize};
 use serde_with::base64::Base64;
 use serde_with::serde_as;
 
 const METADATA_FILE_NAME: &str = "postdata_metadata.json";
 
+/// Size of a block of labels referenced by a single proof index.
+pub const LABELS_BLOCK_SIZE: usize = 16;
+
 #[serde_as]
-#[derive(Debug, Deserialize)]
+#[derive(Debug, Clone, PartialEq, Eq, Deserialize, Serialize)]
 #[serde(rename_all = "PascalCase")]
 pub struct PostMetadata {
     #[serde_as(as = "Base64")]
@@ -20,6 +23,58 @@ pub struct PostMetadata {
     pub max_file_size: u64,
     pub nonce: Option<u64>,
     pub last_position: Option<u64>,
+    /// Checksums of the `postdata_N.bin` files, in order.
+    /// Missing for datasets initialized without them.
+    #[serde_as(as = "Option<Vec<Base64>>")]
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub checksums: Option<Vec<Vec<u8>>>,
+}
+
+impl PostMetadata {
+    /// Total size of the POS data in bytes.
+    pub fn total_size(&self) -> u64 {
+        data_size(self.num_units, self.labels_per_unit, self.bits_per_label)
+    }
+
+    /// Number of `postdata_N.bin` files the POS data is split into.
+    pub fn expected_file_count(&self) -> eyre::Result<usize> {
+        expected_file_count(
+            self.num_units,
+            self.labels_per_unit,
+            self.bits_per_label,
+            self.max_file_size,
+        )
+    }
+
+    /// Number of label blocks, which is also the number of valid proof indices.
+    pub fn num_label_blocks(&self) -> u64 {
+        self.total_size() / LABELS_BLOCK_SIZE as u64
+    }
+}
+
+fn data_size(num_units: u32, labels_per_unit: u64, bits_per_label: u8) -> u64 {
+    num_units as u64 * labels_per_unit * bits_per_label as u64 / 8
+}
+
+/// Number of `postdata_N.bin` files holding `num_units` units of labels
+/// when the data is split into files of `max_file_size` bytes.
+/// All files but the last are full, the last one might be partial.
+///
+/// Fails if `max_file_size` is 0 or the size of the data doesn't fit in a u64.
+pub fn expected_file_count(
+    num_units: u32,
+    labels_per_unit: u64,
+    bits_per_label: u8,
+    max_file_size: u64,
+) -> eyre::Result<usize> {
+    eyre::ensure!(max_file_size > 0, "max file size must be > 0");
+    let bits = (num_units as u64)
+        .checked_mul(labels_per_unit)
+        .and_then(|labels| labels.checked_mul(bits_per_label as u64))
+        .ok_or_else(|| eyre::eyre!("POS data size overflows"))?;
+    let size = bits / 8;
+    let count = size / max_file_size + (size % max_file_size != 0) as u64;
+    usize::try_from(count).map_err(|_| eyre::eyre!("too many POS files: {count}"))
 }
 
 pub fn load(datadir: &Path) -> eyre::Result<PostMetadata> {
@@ -29,3 +84,29 @@ pub fn load(datadir: &Path) -> eyre::Result<PostMetadata> {
     let m = serde_json::from_reader(reader)?;
     Ok(m)
 }
+
+#[cfg(test)]
+mod tests {
+    use super::expected_file_count;
+
+    #[test]
+    fn file_count() {
+        // 4 units of 1024 8-bit labels: 4096 bytes
+        assert_eq!(1, expected_file_count(4, 1024, 8, 4096).unwrap());
+        assert_eq!(1, expected_file_count(4, 1024, 8, 1 << 20).unwrap());
+        assert_eq!(2, expected_file_count(4, 1024, 8, 4095).unwrap());
+        assert_eq!(2, expected_file_count(4, 1024, 8, 2048).unwrap());
+        // the last file is partial
+        assert_eq!(3, expected_file_count(4, 1024, 8, 2047).unwrap());
+        assert_eq!(4096, expected_file_count(4, 1024, 8, 1).unwrap());
+        assert_eq!(0, expected_file_count(0, 1024, 8, 1024).unwrap());
+    }
+
+    #[test]
+    fn file_count_edge_cases() {
+        assert!(expected_file_count(4, 1024, 8, 0).is_err());
+        // Rounding up to whole files must not overflow.
+        assert_eq!(1, expected_file_count(4, 1024, 8, u64::MAX).unwrap());
+        assert!(expected_file_count(2, u64::MAX / 8, 8, u64::MAX).is_err());
+    }
+}
@@ -7,6 +7,8 @@
 //! without actually holding the whole POST data.
 //!
 //! TODO: explain the need for "K3 PoW".
+use std::sync::atomic::{AtomicBool, Ordering};
+
 use scrypt_jane::scrypt::{scrypt, ScryptParams};
 
 pub fn find_k2_pow(challenge: &[u8; 32], nonce: u32, params: ScryptParams, difficulty: u64) -> u64 {
@@ -18,6 +20,19 @@ pub fn find_k2_pow(challenge: &[u8; 32], nonce: u32, params: ScryptParams, diffi
     unreachable!()
 }
 
+/// Like [find_k2_pow], but gives up with `None` once `stop` is set.
+pub fn find_k2_pow_cancellable(
+    challenge: &[u8; 32],
+    nonce: u32,
+    params: ScryptParams,
+    difficulty: u64,
+    stop: &AtomicBool,
+) -> Option<u64> {
+    (0u64..)
+        .take_while(|_| !stop.load(Ordering::Relaxed))
+        .find(|&k2_pow| hash_k2_pow(challenge, nonce, params, k2_pow) < difficulty)
+}
+
 #[inline(always)]
 pub(crate) fn hash_k2_pow(
     challenge: &[u8; 32],
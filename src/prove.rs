@@ -14,18 +14,34 @@ use aes::cipher::BlockEncrypt;
 use cipher::{block_padding::NoPadding, generic_array::GenericArray};
 use eyre::Context;
 use scrypt_jane::scrypt::ScryptParams;
-use std::{collections::HashMap, ops::Range, path::Path};
+use std::{
+    collections::HashMap,
+    io,
+    ops::Range,
+    path::Path,
+    sync::atomic::{AtomicBool, Ordering},
+    thread,
+};
 
 use crate::{
-    cipher::AesCipher, compression::compress_indexes, config::Config,
-    difficulty::proving_difficulty, metadata, reader::read_data,
+    cipher::{aes_backend, AesBackend, AesCipher},
+    compression::{compress_indexes, required_bits},
+    config::Config,
+    difficulty::proving_difficulty,
+    governor::wait_for_low_load,
+    metadata::{self, PostMetadata},
+    pow::{find_k2_pow_cancellable, hash_k2_pow},
+    reader::{
+        corrupt_copies, load_mirrored_metadata, open_mirrored_files, open_pos_files, read_ahead,
+        Batch, ReadError, ReadTrace, TracedFile,
+    },
 };
 
 const BLOCK_SIZE: usize = 16; // size of the aes block
 const AES_BATCH: usize = 8; // will use encrypt8 asm method
 const CHUNK_SIZE: usize = BLOCK_SIZE * AES_BATCH;
 
-#[derive(Debug)]
+#[derive(Debug, Clone, PartialEq, Eq)]
 pub struct Proof {
     pub nonce: u32,
     pub indicies: Vec<u64>,
@@ -33,6 +49,11 @@ pub struct Proof {
     pub k3_pow: u64,
 }
 
+/// Scrypt parameters of the k2 and k3 proofs of work.
+pub(crate) fn pow_scrypt_params() -> ScryptParams {
+    ScryptParams::new(8, 0, 0)
+}
+
 #[derive(Debug, Clone)]
 pub struct ProvingParams {
     pub difficulty: u64,
@@ -51,6 +72,27 @@ pub trait Prover {
     fn get_k2_pow(&self, nonce: u32) -> Option<u64>;
 }
 
+/// A k2 pow given to [ConstDProver::with_k2_pows] doesn't satisfy the difficulty.
+///
+/// Returned inside the [eyre::Report], use `downcast_ref` to tell it apart from other errors.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct InvalidK2Pow {
+    pub nonce_group: u32,
+    pub k2_pow: u64,
+}
+
+impl std::fmt::Display for InvalidK2Pow {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(
+            f,
+            "invalid k2 pow {} for nonce group {}",
+            self.k2_pow, self.nonce_group
+        )
+    }
+}
+
+impl std::error::Error for InvalidK2Pow {}
+
 pub struct ConstDProver {
     ciphers: Vec<AesCipher>,
     difficulty: u64,
@@ -68,6 +110,63 @@ impl ConstDProver {
         }
     }
 
+    /// Like [ConstDProver::new], but stops computing the k2 pows once `stop` is set.
+    pub fn new_cancellable(
+        challenge: &[u8; 32],
+        nonces: Range<u32>,
+        params: ProvingParams,
+        stop: &AtomicBool,
+    ) -> Result<Self, Cancelled> {
+        let start = nonces.start / 2;
+        let end = 1.max(nonces.end / 2);
+        let ciphers = (start..end)
+            .map(|n| {
+                let k2_pow = find_k2_pow_cancellable(
+                    challenge,
+                    n,
+                    params.scrypt,
+                    params.k2_pow_difficulty,
+                    stop,
+                )
+                .ok_or(Cancelled)?;
+                Ok(AesCipher::with_k2_pow(challenge, n, k2_pow))
+            })
+            .collect::<Result<_, Cancelled>>()?;
+        Ok(ConstDProver {
+            ciphers,
+            difficulty: params.difficulty,
+        })
+    }
+
+    /// Create a prover for nonces `0..2 * k2_pows.len()` using already computed k2 pows,
+    /// `k2_pows[i]` being the k2 pow for the nonce group `i`.
+    pub fn with_k2_pows(
+        challenge: &[u8; 32],
+        k2_pows: &[u64],
+        params: ProvingParams,
+    ) -> eyre::Result<Self> {
+        eyre::ensure!(!k2_pows.is_empty(), "no k2 pows given");
+        let ciphers = k2_pows
+            .iter()
+            .zip(0u32..)
+            .map(|(&k2_pow, nonce_group)| {
+                let hash = hash_k2_pow(challenge, nonce_group, params.scrypt, k2_pow);
+                if hash >= params.k2_pow_difficulty {
+                    return Err(InvalidK2Pow {
+                        nonce_group,
+                        k2_pow,
+                    }
+                    .into());
+                }
+                Ok(AesCipher::with_k2_pow(challenge, nonce_group, k2_pow))
+            })
+            .collect::<eyre::Result<_>>()?;
+        Ok(ConstDProver {
+            ciphers,
+            difficulty: params.difficulty,
+        })
+    }
+
     fn cipher(&self, nonce: u32) -> Option<&AesCipher> {
         self.ciphers.get((nonce as usize / 2) % self.ciphers.len())
     }
@@ -179,74 +278,602 @@ impl Prover for ConstDVarBProver {
     }
 }
 
+/// The [Config] doesn't suit the POS data, e.g. `k1` is larger than the number of label blocks.
+///
+/// Returned inside the [eyre::Report] as the context of the cause,
+/// use `downcast_ref` to tell it apart from other errors.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct InvalidConfig;
+
+impl std::fmt::Display for InvalidConfig {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "invalid proving config")
+    }
+}
+
+fn proving_params(metadata: &PostMetadata, cfg: &Config) -> eyre::Result<ProvingParams> {
+    let num_labels = metadata.num_units as u64 * metadata.labels_per_unit;
+    Ok(ProvingParams {
+        scrypt: pow_scrypt_params(),
+        difficulty: proving_difficulty(num_labels, cfg.b, cfg.k1).wrap_err(InvalidConfig)?,
+        k2_pow_difficulty: cfg.k2_pow_difficulty,
+        k3_pow_difficulty: cfg.k3_pow_difficulty,
+    })
+}
+
+/// Size of the batches the POS data is read in when proving, unless set in the [Config].
+const READ_BATCH_SIZE: usize = 1024 * 1024;
+
+/// The read size from the [Config], rounded up to a multiple of the chunks
+/// the prover searches, so no batch ends with a partial chunk it would skip.
+fn read_batch_size(cfg: &Config) -> usize {
+    match cfg.read_batch_size {
+        0 => READ_BATCH_SIZE,
+        size => size.saturating_add(CHUNK_SIZE - 1) / CHUNK_SIZE * CHUNK_SIZE,
+    }
+}
+
 /// Generate a proof that data is still held, given the challenge.
 pub fn generate_proof(datadir: &Path, challenge: &[u8; 32], cfg: Config) -> eyre::Result<Proof> {
+    generate_proof_streaming(datadir, challenge, cfg, |_| {})
+}
+
+/// Phase of proof generation.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ProvingPhase {
+    /// Finding k2 proofs of work for the nonces of the next pass over the data.
+    K2Pow,
+    /// Searching the data for labels satisfying the difficulty.
+    Searching,
+    /// Finding the k3 proof of work for the found indices.
+    K3Pow,
+}
+
+/// Progress of proof generation reported by [generate_proof_streaming].
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct ProvingProgress {
+    /// Number of nonces tried so far, including the ones of the current pass.
+    pub nonces_tried: u32,
+    /// The most indices found for a single nonce in the current pass.
+    pub indices_found: usize,
+    pub phase: ProvingPhase,
+}
+
+/// Like [generate_proof], but calls `progress` as the proof generation advances:
+/// before every pass over the data, after every batch of data is searched
+/// and once enough indices are found.
+pub fn generate_proof_streaming<F>(
+    datadir: &Path,
+    challenge: &[u8; 32],
+    cfg: Config,
+    progress: F,
+) -> eyre::Result<Proof>
+where
+    F: FnMut(&ProvingProgress),
+{
+    generate_proof_with(datadir, challenge, cfg, Progress::new(progress))
+}
+
+/// Proof generation was stopped before finding a proof.
+///
+/// Returned inside the [eyre::Report] by [generate_proof_cancellable].
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct Cancelled;
+
+impl std::fmt::Display for Cancelled {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "proof generation was cancelled")
+    }
+}
+
+impl std::error::Error for Cancelled {}
+
+/// Like [generate_proof], but stops with a [Cancelled] error once `stop` is set,
+/// e.g. from another thread. It's checked between batches of data
+/// and while computing the k2 pows.
+pub fn generate_proof_cancellable(
+    datadir: &Path,
+    challenge: &[u8; 32],
+    cfg: Config,
+    stop: &AtomicBool,
+) -> eyre::Result<Proof> {
+    let progress = Progress {
+        stop: Some(stop),
+        ..Progress::new(|_: &ProvingProgress| {})
+    };
+    generate_proof_with(datadir, challenge, cfg, progress)
+}
+
+fn generate_proof_with<F>(
+    datadir: &Path,
+    challenge: &[u8; 32],
+    cfg: Config,
+    progress: Progress<F>,
+) -> eyre::Result<Proof>
+where
+    F: FnMut(&ProvingProgress),
+{
     let metadata = metadata::load(datadir).wrap_err("loading metadata")?;
+    let layout = (&metadata, cfg.on_oversized_file);
+    let batch_size = read_batch_size(&cfg);
+    generate_proof_from(
+        &metadata,
+        challenge,
+        &cfg,
+        |checksums| {
+            open_pos_files(
+                datadir,
+                batch_size,
+                Some(layout),
+                checksums,
+                |_| true,
+                |file, _| file,
+            )
+        },
+        progress,
+    )
+}
 
-    let num_labels = metadata.num_units as u64 * metadata.labels_per_unit;
-    let difficulty = proving_difficulty(num_labels, cfg.b, cfg.k1)?;
+/// Like [generate_proof], but calls `trace` for every read of the POS data,
+/// e.g. to analyze the read pattern for storage tuning.
+pub fn generate_proof_traced<F>(
+    datadir: &Path,
+    challenge: &[u8; 32],
+    cfg: Config,
+    trace: F,
+) -> eyre::Result<Proof>
+where
+    F: Fn(&ReadTrace) + Clone + Send + Sync,
+{
+    let metadata = metadata::load(datadir).wrap_err("loading metadata")?;
+    let layout = (&metadata, cfg.on_oversized_file);
+    let batch_size = read_batch_size(&cfg);
+    generate_proof_from(
+        &metadata,
+        challenge,
+        &cfg,
+        |checksums| {
+            open_pos_files(
+                datadir,
+                batch_size,
+                Some(layout),
+                checksums,
+                |_| true,
+                |file, offset| TracedFile::new(file, offset, trace.clone()),
+            )
+        },
+        Progress::new(|_: &ProvingProgress| {}),
+    )
+}
+
+/// Like [generate_proof], but searches only the `postdata_N.bin` files with `N` in `files`,
+/// e.g. to check files that were re-initialized. Indices in the proof refer to
+/// the whole POS data. The less data is searched, the more nonces it takes to find a proof.
+pub fn generate_proof_for_files(
+    datadir: &Path,
+    challenge: &[u8; 32],
+    cfg: Config,
+    files: &[usize],
+) -> eyre::Result<Proof> {
+    let metadata = metadata::load(datadir).wrap_err("loading metadata")?;
+    for index in files {
+        let path = datadir.join(format!("postdata_{index}.bin"));
+        eyre::ensure!(path.is_file(), "{path:?} doesn't exist");
+    }
+    let layout = (&metadata, cfg.on_oversized_file);
+    let batch_size = read_batch_size(&cfg);
+    generate_proof_from(
+        &metadata,
+        challenge,
+        &cfg,
+        |checksums| {
+            open_pos_files(
+                datadir,
+                batch_size,
+                Some(layout),
+                checksums,
+                |index| files.contains(&index),
+                |file, _| file,
+            )
+        },
+        Progress::new(|_: &ProvingProgress| {}),
+    )
+}
+
+/// Like [generate_proof], but reads the POS data from the first of `datadirs`, falling back
+/// to copies of it in the others when reading a file fails.
+/// See [read_data_mirrored](crate::reader::read_data_mirrored).
+/// The metadata is loaded from the first directory where it can be, see
+/// [load_mirrored_metadata].
+///
+/// With [Config::verify_checksums], copies of files not matching their checksums are
+/// skipped too. A mismatch shows only once a file is read to the end, so proving then
+/// starts over without the corrupt copies.
+///
+/// Fails if a file can't be read from any of the directories.
+pub fn generate_proof_mirrored(
+    datadirs: &[&Path],
+    challenge: &[u8; 32],
+    cfg: Config,
+) -> eyre::Result<Proof> {
+    let metadata = load_mirrored_metadata(datadirs)?;
+    let batch_size = read_batch_size(&cfg);
+    let mut corrupt = Vec::new();
+    loop {
+        let result = generate_proof_from(
+            &metadata,
+            challenge,
+            &cfg,
+            |checksums| {
+                open_mirrored_files(
+                    datadirs,
+                    &metadata,
+                    batch_size,
+                    cfg.on_oversized_file,
+                    checksums,
+                    &corrupt,
+                )
+            },
+            Progress::new(|_: &ProvingProgress| {}),
+        );
+        let Some(file) = result.as_ref().err().and_then(corrupt_file) else {
+            return result;
+        };
+        let copies: Vec<_> = corrupt_copies(datadirs, &metadata, file, cfg.on_oversized_file)
+            .into_iter()
+            .filter(|copy| !corrupt.contains(copy))
+            .collect();
+        if copies.is_empty() {
+            return result;
+        }
+        log::warn!("{copies:?} don't match their checksum, proving again without them");
+        corrupt.extend(copies);
+    }
+}
+
+/// The index `N` of the `postdata_N.bin` file that doesn't match its checksum,
+/// if that's what the error is about.
+fn corrupt_file(err: &eyre::Report) -> Option<usize> {
+    err.chain().find_map(|cause| {
+        let err = cause.downcast_ref::<io::Error>()?.get_ref()?;
+        match err.downcast_ref::<ReadError>()? {
+            ReadError::Corrupt { file } => Some(*file),
+            _ => None,
+        }
+    })
+}
+
+/// A proof over only the first units of the POS data.
+///
+/// It is NOT a proof for the whole data and must never be used in production.
+/// It lets the proving pipeline run on machines that can't hold full capacity.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct PartialProof {
+    pub proof: Proof,
+    /// Metadata of the proven part of the data, to verify the proof against.
+    pub metadata: PostMetadata,
+}
+
+/// Generate a [PartialProof] over the first `num_units` units of the POS data.
+///
+/// With [Config::verify_checksums], only the files read to the end are checked.
+pub fn generate_partial_proof(
+    datadir: &Path,
+    challenge: &[u8; 32],
+    cfg: Config,
+    num_units: u32,
+) -> eyre::Result<PartialProof> {
+    let metadata = metadata::load(datadir).wrap_err("loading metadata")?;
+    eyre::ensure!(
+        num_units > 0 && num_units <= metadata.num_units,
+        "can't prove {num_units} of {} units",
+        metadata.num_units
+    );
+    log::warn!(
+        "generating a non-production proof for {num_units} of {} units",
+        metadata.num_units
+    );
+    let partial = PostMetadata {
+        num_units,
+        ..metadata.clone()
+    };
+    let size = partial.total_size();
+    let layout = (&metadata, cfg.on_oversized_file);
+    let batch_size = read_batch_size(&cfg);
+    let proof = generate_proof_from(
+        &partial,
+        challenge,
+        &cfg,
+        |checksums| {
+            let batches = open_pos_files(
+                datadir,
+                batch_size,
+                Some(layout),
+                checksums,
+                |_| true,
+                |file, _| file,
+            )?;
+            Ok(take_bytes(batches, size))
+        },
+        Progress::new(|_: &ProvingProgress| {}),
+    )?;
+    Ok(PartialProof {
+        proof,
+        metadata: partial,
+    })
+}
+
+/// Limit the POS data to the first `size` bytes.
+fn take_bytes(
+    batches: impl Iterator<Item = io::Result<Batch>>,
+    size: u64,
+) -> impl Iterator<Item = io::Result<Batch>> {
+    batches.map_while(move |batch| {
+        let mut batch = match batch {
+            Ok(batch) => batch,
+            Err(e) => return Some(Err(e)),
+        };
+        let remaining = size.checked_sub(batch.index).filter(|&r| r > 0)?;
+        batch
+            .data
+            .truncate(remaining.min(batch.data.len() as u64) as usize);
+        Some(Ok(batch))
+    })
+}
+
+/// Generate a proof, reading the POS data with `read` on every pass over it.
+///
+/// `read` is given the checksums to check the files against as they're read, if any.
+/// With [Config::verify_checksums] they're given on the first pass, which then reads
+/// all of the data even if a proof is found early, so every file is checked once.
+fn generate_proof_from<R, I, F>(
+    metadata: &PostMetadata,
+    challenge: &[u8; 32],
+    cfg: &Config,
+    read: R,
+    mut progress: Progress<F>,
+) -> eyre::Result<Proof>
+where
+    R: Fn(Option<&[Vec<u8>]>) -> eyre::Result<I>,
+    I: Iterator<Item = io::Result<Batch>> + Send,
+    F: FnMut(&ProvingProgress),
+{
+    let params = proving_params(metadata, cfg)?;
+    let checksums = metadata
+        .checksums
+        .as_deref()
+        .filter(|_| cfg.verify_checksums);
+    if aes_backend() == AesBackend::Software {
+        log::warn!("the CPU doesn't support AES instructions, proving will be very slow");
+    }
 
     let mut start_nonce = 0;
     let mut end_nonce = start_nonce + cfg.n;
+    for pass in 1.. {
+        progress.nonces_tried = end_nonce;
+        progress.report(0, ProvingPhase::K2Pow);
+        let nonces = start_nonce..end_nonce;
+        let prover = match progress.stop {
+            Some(stop) => ConstDProver::new_cancellable(challenge, nonces, params.clone(), stop)?,
+            None => ConstDProver::new(challenge, nonces, params.clone()),
+        };
+        let checksums = checksums.filter(|_| pass == 1);
+        let found = thread::scope(|scope| -> eyre::Result<_> {
+            let mut batches = read_ahead(scope, read(checksums)?, cfg.read_ahead);
+            let found = search_data(
+                batches.by_ref(),
+                challenge,
+                &prover,
+                metadata,
+                &params,
+                cfg,
+                &mut progress,
+            )?;
+            if found.is_some() && checksums.is_some() {
+                read_to_end(batches)?;
+            }
+            Ok(found)
+        })?;
+        if let Some(proof) = found {
+            return Ok(proof);
+        }
+        eyre::ensure!(
+            pass != cfg.max_passes,
+            "no proof found in {pass} passes over the POS data"
+        );
 
-    let params = ProvingParams {
-        scrypt: ScryptParams::new(8, 0, 0),
-        difficulty,
-        k2_pow_difficulty: cfg.k2_pow_difficulty,
-        k3_pow_difficulty: cfg.k3_pow_difficulty,
-    };
+        (start_nonce, end_nonce) = (end_nonce, end_nonce + cfg.n);
+    }
+    unreachable!()
+}
 
-    loop {
-        for batch in read_data(datadir, 1024 * 1024) {
-            let mut indexes = HashMap::<u32, Vec<u64>>::new();
+/// Generate a proof using k2 pows computed elsewhere, e.g. on dedicated hardware.
+///
+/// `k2_pows[i]` is the k2 pow for the nonce group `i`, so only nonces `0..2 * k2_pows.len()`
+/// are tried. Fails if any of the k2 pows is invalid, with an [InvalidK2Pow] error,
+/// or none of the nonces yields a proof. The k2 pows are never recomputed.
+pub fn generate_proof_with_k2_pows(
+    datadir: &Path,
+    challenge: &[u8; 32],
+    cfg: Config,
+    k2_pows: &[u64],
+) -> eyre::Result<Proof> {
+    let metadata = metadata::load(datadir).wrap_err("loading metadata")?;
+    let params = proving_params(&metadata, &cfg)?;
 
-            let prover = ConstDProver::new(challenge, start_nonce..end_nonce, params.clone());
-            let result = prover.prove(&batch.data, batch.index, |nonce, index| {
-                let vec = indexes.entry(nonce).or_default();
-                vec.push(index);
-                if vec.len() >= cfg.k2 as usize {
-                    return Some(std::mem::take(vec));
-                }
-                None
-            });
-            if let Some((nonce, indexes)) = result {
-                let total_labels = metadata.num_units as u64
-                    * metadata.labels_per_unit
-                    * metadata.bits_per_label as u64
-                    / 8;
-                // Labels are indexed in blocks of 16
-                let max_index = total_labels / 16;
-                let required_bits = (max_index as f64).log2() as usize + 1;
-
-                let compressed_indexes = compress_indexes(&indexes, required_bits);
-                let k3_pow = crate::pow::find_k3_pow(
-                    challenge,
-                    nonce,
-                    &compressed_indexes,
-                    params.scrypt,
-                    params.k3_pow_difficulty,
-                    prover.cipher(nonce).unwrap().k2_pow,
+    let prover = ConstDProver::with_k2_pows(challenge, k2_pows, params.clone())?;
+    let checksums = metadata
+        .checksums
+        .as_deref()
+        .filter(|_| cfg.verify_checksums);
+    let batches = open_pos_files(
+        datadir,
+        read_batch_size(&cfg),
+        Some((&metadata, cfg.on_oversized_file)),
+        checksums,
+        |_| true,
+        |file, _| file,
+    )?;
+    let mut progress = Progress::new(|_: &ProvingProgress| {});
+    progress.nonces_tried = 2 * k2_pows.len() as u32;
+    thread::scope(|scope| -> eyre::Result<_> {
+        let mut batches = read_ahead(scope, batches, cfg.read_ahead);
+        let found = search_data(
+            batches.by_ref(),
+            challenge,
+            &prover,
+            &metadata,
+            &params,
+            &cfg,
+            &mut progress,
+        )?;
+        if found.is_some() && checksums.is_some() {
+            read_to_end(batches)?;
+        }
+        Ok(found)
+    })?
+    .ok_or_else(|| eyre::eyre!("no proof found with {} given k2 pows", k2_pows.len()))
+}
+
+/// Read the rest of the POS data, for the files not read to the end yet
+/// to be checked against their checksums.
+fn read_to_end(batches: impl Iterator<Item = io::Result<Batch>>) -> eyre::Result<()> {
+    for batch in batches {
+        batch.wrap_err("reading POS data")?;
+    }
+    Ok(())
+}
+
+/// State of proof generation carried across passes over the data.
+struct Progress<'a, F> {
+    report: F,
+    /// Stop proving once set.
+    stop: Option<&'a AtomicBool>,
+    nonces_tried: u32,
+    bytes_read: u64,
+}
+
+impl<F: FnMut(&ProvingProgress)> Progress<'_, F> {
+    fn new(report: F) -> Self {
+        Self {
+            report,
+            stop: None,
+            nonces_tried: 0,
+            bytes_read: 0,
+        }
+    }
+
+    fn cancelled(&self) -> bool {
+        self.stop.map_or(false, |stop| stop.load(Ordering::Relaxed))
+    }
+
+    fn report(&mut self, indices_found: usize, phase: ProvingPhase) {
+        (self.report)(&ProvingProgress {
+            nonces_tried: self.nonces_tried,
+            indices_found,
+            phase,
+        });
+    }
+}
+
+/// Search the whole POS data once for a proof using the nonces of the prover.
+fn search_data<F: FnMut(&ProvingProgress)>(
+    batches: impl Iterator<Item = io::Result<Batch>>,
+    challenge: &[u8; 32],
+    prover: &ConstDProver,
+    metadata: &PostMetadata,
+    params: &ProvingParams,
+    cfg: &Config,
+    progress: &mut Progress<F>,
+) -> eyre::Result<Option<Proof>> {
+    let total_labels = metadata.total_size();
+    // Kept across batches, so the indices for a nonce can come from any part of the data
+    // and the proof doesn't depend on how the data is split into batches.
+    let mut indexes = HashMap::<u32, Vec<u64>>::new();
+
+    for batch in batches {
+        if progress.cancelled() {
+            return Err(Cancelled.into());
+        }
+        let batch = batch.wrap_err("reading POS data")?;
+        if cfg.pause_load_average > 0.0 {
+            wait_for_low_load(cfg.pause_load_average, cfg.resume_load_average);
+        }
+        progress.bytes_read += batch.data.len() as u64;
+
+        // The prover counts indexes in blocks of labels, batches are indexed in bytes.
+        let index = batch.index / BLOCK_SIZE as u64;
+        let result = prover.prove(&batch.data, index, |nonce, index| {
+            let vec = indexes.entry(nonce).or_default();
+            vec.push(index);
+            if vec.len() >= cfg.k2 as usize {
+                return Some(std::mem::take(vec));
+            }
+            None
+        });
+        if let Some((nonce, indexes)) = result {
+            progress.report(indexes.len(), ProvingPhase::K3Pow);
+            let bytes_read = progress.bytes_read;
+            if is_suspiciously_fast(bytes_read, total_labels, cfg) {
+                log::warn!(
+                    "found a proof after reading only {bytes_read}B of {total_labels}B of data, is the difficulty (k1: {}, k2: {}) misconfigured?",
+                    cfg.k1,
+                    cfg.k2
                 );
-                return Ok(Proof {
-                    nonce,
-                    // TODO(poszu) include compressed indexes once we move verification to this library.
-                    indicies: indexes,
-                    k2_pow: prover.get_k2_pow(nonce).unwrap(),
-                    k3_pow,
-                });
             }
+            let max_index = metadata.num_label_blocks();
+
+            let compressed_indexes = compress_indexes(&indexes, required_bits(max_index));
+            let k3_pow = crate::pow::find_k3_pow(
+                challenge,
+                nonce,
+                &compressed_indexes,
+                params.scrypt,
+                params.k3_pow_difficulty,
+                prover.cipher(nonce).unwrap().k2_pow,
+            );
+            return Ok(Some(Proof {
+                nonce,
+                // TODO(poszu) include compressed indexes once we move verification to this library.
+                indicies: indexes,
+                k2_pow: prover.get_k2_pow(nonce).unwrap(),
+                k3_pow,
+            }));
         }
+        let indices_found = indexes.values().map(Vec::len).max().unwrap_or_default();
+        progress.report(indices_found, ProvingPhase::Searching);
+    }
+    Ok(None)
+}
 
-        (start_nonce, end_nonce) = (end_nonce, end_nonce + cfg.n);
+/// Check if a proof was found after reading much less data than expected.
+///
+/// On average `k1` labels satisfy the difficulty for a nonce in a pass over the whole data,
+/// so collecting `k2` of them takes reading about `k2 / k1` of the data.
+fn is_suspiciously_fast(bytes_read: u64, total_size: u64, cfg: &Config) -> bool {
+    if cfg.fast_proof_warning_ratio <= 0.0 || cfg.k1 == 0 {
+        return false;
     }
+    let expected = total_size as f64 * cfg.k2 as f64 / cfg.k1 as f64;
+    (bytes_read as f64) < expected * cfg.fast_proof_warning_ratio
 }
 
 #[cfg(test)]
-mod tests {
+pub(crate) mod tests {
     use super::*;
-    use crate::difficulty::proving_difficulty;
+    use crate::{
+        difficulty::proving_difficulty,
+        pow::find_k2_pow,
+        verify::{verify_with_labels, VerifyConfig},
+    };
     use rand::{thread_rng, RngCore};
-    use std::{collections::HashMap, iter::repeat};
+    use std::{
+        collections::HashMap,
+        fs::File,
+        io::{Seek, Write},
+        iter::repeat,
+    };
+    use tempfile::{tempdir, TempDir};
 
     #[test]
     fn sanity() {
@@ -401,6 +1028,173 @@ mod tests {
         }
     }
 
+    #[test]
+    fn cancelling_k2_pows() {
+        let challenge = b"hello world, challenge me!!!!!!!";
+        // No k2 pow satisfies the difficulty, computing them never ends unless stopped.
+        let params = ProvingParams {
+            scrypt: ScryptParams::new(8, 0, 0),
+            difficulty: u64::MAX,
+            k2_pow_difficulty: 0,
+            k3_pow_difficulty: u64::MAX,
+        };
+        let stop = AtomicBool::new(true);
+        assert_eq!(
+            Some(Cancelled),
+            ConstDProver::new_cancellable(challenge, 0..4, params.clone(), &stop).err()
+        );
+
+        let params = ProvingParams {
+            k2_pow_difficulty: u64::MAX,
+            ..params
+        };
+        stop.store(false, Ordering::Relaxed);
+        let prover = ConstDProver::new_cancellable(challenge, 0..4, params, &stop).unwrap();
+        assert_eq!(2, prover.required_aeses());
+    }
+
+    #[test]
+    fn prover_with_k2_pows() {
+        let challenge = b"hello world, challenge me!!!!!!!";
+        let params = ProvingParams {
+            scrypt: ScryptParams::new(8, 0, 0),
+            difficulty: u64::MAX,
+            k2_pow_difficulty: u64::MAX / 8,
+            k3_pow_difficulty: u64::MAX,
+        };
+        let k2_pows = (0..4)
+            .map(|group| {
+                crate::pow::find_k2_pow(challenge, group, params.scrypt, params.k2_pow_difficulty)
+            })
+            .collect::<Vec<_>>();
+
+        let prover = ConstDProver::with_k2_pows(challenge, &k2_pows, params.clone()).unwrap();
+        assert_eq!(4, prover.required_aeses());
+        for nonce in 0..8 {
+            assert_eq!(Some(k2_pows[nonce as usize / 2]), prover.get_k2_pow(nonce));
+        }
+
+        let params = ProvingParams {
+            k2_pow_difficulty: 0,
+            ..params
+        };
+        let Err(err) = ConstDProver::with_k2_pows(challenge, &k2_pows, params.clone()) else {
+            panic!("k2 pows must not satisfy difficulty 0");
+        };
+        assert_eq!(
+            Some(&InvalidK2Pow {
+                nonce_group: 0,
+                k2_pow: k2_pows[0]
+            }),
+            err.downcast_ref::<InvalidK2Pow>()
+        );
+        let Err(err) = ConstDProver::with_k2_pows(challenge, &[], params) else {
+            panic!("k2 pows are required");
+        };
+        assert!(err.downcast_ref::<InvalidK2Pow>().is_none());
+    }
+
+    #[test]
+    fn collecting_indices_across_batches() {
+        let challenge = b"hello world, challenge me!!!!!!!";
+        let params = ProvingParams {
+            scrypt: ScryptParams::new(8, 0, 0),
+            difficulty: u64::MAX,
+            k2_pow_difficulty: u64::MAX,
+            k3_pow_difficulty: u64::MAX,
+        };
+        let metadata = PostMetadata {
+            node_id: vec![],
+            commitment_atx_id: vec![],
+            bits_per_label: 8,
+            labels_per_unit: 256,
+            num_units: 1,
+            max_file_size: 256,
+            nonce: None,
+            last_position: None,
+            checksums: None,
+        };
+        let cfg = Config {
+            k2: 12,
+            ..Config::default()
+        };
+        let prover = ConstDProver::new(challenge, 0..2, params.clone());
+        // Every label satisfies the difficulty, but a batch holds only 8 label blocks.
+        let batches = (0..2).map(|i| {
+            Ok(Batch {
+                data: vec![0; CHUNK_SIZE],
+                index: i * CHUNK_SIZE as u64,
+            })
+        });
+
+        let proof = search_data(
+            batches,
+            challenge,
+            &prover,
+            &metadata,
+            &params,
+            &cfg,
+            &mut Progress::new(|_: &ProvingProgress| {}),
+        )
+        .unwrap()
+        .unwrap();
+        assert_eq!(0, proof.nonce);
+        assert_eq!((0..12).collect::<Vec<u64>>(), proof.indicies);
+    }
+
+    #[test]
+    fn taking_bytes_of_data() {
+        let batches = (0..4).map(|i| {
+            Ok(Batch {
+                data: vec![i; 4],
+                index: i as u64 * 4,
+            })
+        });
+        let taken = take_bytes(batches.clone(), 6)
+            .collect::<io::Result<Vec<_>>>()
+            .unwrap();
+        assert_eq!(
+            vec![
+                Batch {
+                    data: vec![0; 4],
+                    index: 0
+                },
+                Batch {
+                    data: vec![1; 2],
+                    index: 4
+                },
+            ],
+            taken
+        );
+        assert_eq!(4, take_bytes(batches.clone(), 100).count());
+        assert_eq!(0, take_bytes(batches, 0).count());
+    }
+
+    #[test]
+    fn detect_suspiciously_fast_proof() {
+        let cfg = Config {
+            labels_per_unit: 1024,
+            k1: 100,
+            k2: 50,
+            k2_pow_difficulty: u64::MAX,
+            k3_pow_difficulty: u64::MAX,
+            b: 16,
+            n: 2,
+            fast_proof_warning_ratio: 0.1,
+            ..Config::default()
+        };
+        // about half of the data is expected to be read
+        assert!(!is_suspiciously_fast(500, 1000, &cfg));
+        assert!(!is_suspiciously_fast(50, 1000, &cfg));
+        assert!(is_suspiciously_fast(49, 1000, &cfg));
+
+        let cfg = Config {
+            fast_proof_warning_ratio: 0.0,
+            ..cfg
+        };
+        assert!(!is_suspiciously_fast(0, 1000, &cfg));
+    }
+
     #[test]
     fn proving_vector() {
         let challenge = b"hello world, CHALLENGE me!!!!!!!";
@@ -443,4 +1237,388 @@ mod tests {
             indexes.as_slice()
         );
     }
+
+    /// Write the given data as POS files along with the metadata.
+    fn write_pos_data(datadir: &Path, data: &[u8], metadata: &PostMetadata) {
+        for (i, chunk) in data.chunks(metadata.max_file_size as usize).enumerate() {
+            let mut file = File::create(datadir.join(format!("postdata_{i}.bin"))).unwrap();
+            file.write_all(chunk).unwrap();
+        }
+        let metadata = serde_json::json!({
+            "NodeId": "",
+            "CommitmentAtxId": "",
+            "BitsPerLabel": metadata.bits_per_label,
+            "LabelsPerUnit": metadata.labels_per_unit,
+            "NumUnits": metadata.num_units,
+            "MaxFileSize": metadata.max_file_size,
+        });
+        let file = File::create(datadir.join("postdata_metadata.json")).unwrap();
+        serde_json::to_writer(file, &metadata).unwrap();
+    }
+
+    /// Random POS data of 4 units with 8-bit labels in 1 MiB files, written to a new directory.
+    pub(crate) fn pos_data(labels_per_unit: u64) -> (TempDir, Vec<u8>, PostMetadata) {
+        let metadata = PostMetadata {
+            node_id: vec![0; 32],
+            commitment_atx_id: vec![0; 32],
+            bits_per_label: 8,
+            labels_per_unit,
+            num_units: 4,
+            max_file_size: 1024 * 1024,
+            nonce: None,
+            last_position: None,
+            checksums: None,
+        };
+        let mut data = vec![0u8; metadata.total_size() as usize];
+        thread_rng().fill_bytes(&mut data);
+        let datadir = tempdir().unwrap();
+        write_pos_data(datadir.path(), &data, &metadata);
+        (datadir, data, metadata)
+    }
+
+    /// The labels the proof points to.
+    pub(crate) fn labels_for(data: &[u8], proof: &Proof) -> Vec<[u8; 16]> {
+        proof
+            .indicies
+            .iter()
+            .map(|&i| {
+                data[i as usize * 16..(i as usize + 1) * 16]
+                    .try_into()
+                    .unwrap()
+            })
+            .collect()
+    }
+
+    pub(crate) fn proving_config() -> Config {
+        Config {
+            labels_per_unit: 512 * 1024,
+            k1: 100,
+            k2: 50,
+            k2_pow_difficulty: u64::MAX / 4,
+            k3_pow_difficulty: u64::MAX / 4,
+            b: 16,
+            n: 8,
+            ..Config::default()
+        }
+    }
+
+    #[test]
+    fn proving_from_mirrors() {
+        let challenge = b"hello world, CHALLENGE me!!!!!!!";
+        let (primary, data, metadata) = pos_data(512 * 1024);
+        let mirror = tempdir().unwrap();
+        write_pos_data(mirror.path(), &data, &metadata);
+        let proof = generate_proof(primary.path(), challenge, proving_config()).unwrap();
+
+        // A file that can't be read is read from the mirror.
+        std::fs::remove_file(primary.path().join("postdata_1.bin")).unwrap();
+        std::fs::create_dir(primary.path().join("postdata_1.bin")).unwrap();
+        let dirs = [primary.path(), mirror.path()];
+        assert_eq!(
+            proof,
+            generate_proof_mirrored(&dirs, challenge, proving_config()).unwrap()
+        );
+
+        // So is the metadata.
+        std::fs::remove_file(primary.path().join("postdata_metadata.json")).unwrap();
+        assert_eq!(
+            proof,
+            generate_proof_mirrored(&dirs, challenge, proving_config()).unwrap()
+        );
+
+        // Without a readable copy, proving fails instead of searching less data.
+        assert!(generate_proof_mirrored(&dirs[..1], challenge, proving_config()).is_err());
+    }
+
+    #[test]
+    fn proving_with_checksums() {
+        let challenge = b"hello world, CHALLENGE me!!!!!!!";
+        let (primary, data, mut metadata) = pos_data(512 * 1024);
+        metadata.checksums = Some(crate::reader::compute_checksums(primary.path()).unwrap());
+        let mirror = tempdir().unwrap();
+        write_pos_data(mirror.path(), &data, &metadata);
+        for dir in [&primary, &mirror] {
+            let file = File::create(dir.path().join("postdata_metadata.json")).unwrap();
+            serde_json::to_writer(file, &metadata).unwrap();
+        }
+        let cfg = || Config {
+            verify_checksums: true,
+            ..proving_config()
+        };
+        let proof = generate_proof(primary.path(), challenge, proving_config()).unwrap();
+        assert_eq!(
+            proof,
+            generate_proof(primary.path(), challenge, cfg()).unwrap()
+        );
+
+        // The end of the data is corrupt. It's read to be checked even if a proof
+        // is found before.
+        let mut last = data[data.len() - 16..].to_vec();
+        last[15] ^= 0xFF;
+        let path = primary.path().join("postdata_1.bin");
+        let mut file = std::fs::OpenOptions::new().write(true).open(path).unwrap();
+        file.seek(io::SeekFrom::End(-16)).unwrap();
+        file.write_all(&last).unwrap();
+        let err = generate_proof(primary.path(), challenge, cfg()).unwrap_err();
+        assert_eq!(Some(1), corrupt_file(&err));
+        let k2_pows = [find_k2_pow(
+            challenge,
+            0,
+            pow_scrypt_params(),
+            proving_config().k2_pow_difficulty,
+        )];
+        let err =
+            generate_proof_with_k2_pows(primary.path(), challenge, cfg(), &k2_pows).unwrap_err();
+        assert_eq!(Some(1), corrupt_file(&err));
+
+        // The corrupt copy is skipped in favor of the mirror.
+        let dirs = [primary.path(), mirror.path()];
+        assert_eq!(
+            proof,
+            generate_proof_mirrored(&dirs, challenge, cfg()).unwrap()
+        );
+        assert!(generate_proof_mirrored(&dirs[..1], challenge, cfg()).is_err());
+    }
+
+    #[test]
+    fn proving_with_read_ahead() {
+        let challenge = b"hello world, CHALLENGE me!!!!!!!";
+        let (datadir, _, _) = pos_data(512 * 1024);
+
+        let proof = generate_proof(datadir.path(), challenge, proving_config()).unwrap();
+        // The data is searched in the same order however it's read.
+        for (read_batch_size, read_ahead) in [(4096, 0), (4096, 3), (0, 1), (1000, 2)] {
+            let cfg = Config {
+                read_batch_size,
+                read_ahead,
+                ..proving_config()
+            };
+            assert_eq!(
+                proof,
+                generate_proof(datadir.path(), challenge, cfg).unwrap()
+            );
+        }
+    }
+
+    #[test]
+    fn proving_with_unaligned_read_size() {
+        let challenge = b"hello world, CHALLENGE me!!!!!!!";
+        let (datadir, data, metadata) = pos_data(512 * 1024);
+        let cfg = Config {
+            read_batch_size: 1000,
+            ..proving_config()
+        };
+        assert_eq!(1024, read_batch_size(&cfg));
+
+        let proof = generate_proof(datadir.path(), challenge, cfg).unwrap();
+        let labels = labels_for(&data, &proof);
+        assert_eq!(
+            Ok(()),
+            verify_with_labels(
+                challenge,
+                &proof,
+                &metadata,
+                &proving_config(),
+                &labels,
+                &VerifyConfig::default()
+            )
+        );
+    }
+
+    #[test]
+    fn proving_traced() {
+        let challenge = b"hello world, CHALLENGE me!!!!!!!";
+        let (datadir, data, _) = pos_data(512 * 1024);
+
+        let reads = std::sync::Mutex::new(Vec::new());
+        let proof = generate_proof_traced(datadir.path(), challenge, proving_config(), |read| {
+            reads.lock().unwrap().push((read.offset, read.len))
+        })
+        .unwrap();
+        assert_eq!(
+            proof,
+            generate_proof(datadir.path(), challenge, proving_config()).unwrap()
+        );
+
+        let reads = reads.into_inner().unwrap();
+        assert!(!reads.is_empty());
+        assert!(reads
+            .iter()
+            .all(|&(offset, len)| offset as usize + len <= data.len()));
+    }
+
+    #[test]
+    fn giving_up_after_max_passes() {
+        let challenge = b"hello world, CHALLENGE me!!!!!!!";
+        let (datadir, _, _) = pos_data(128 * 1024);
+        // More indices than label blocks, no nonce can find them all.
+        let cfg = Config {
+            k2: 1 << 20,
+            max_passes: 2,
+            ..proving_config()
+        };
+
+        let mut passes = 0;
+        let err = generate_proof_streaming(datadir.path(), challenge, cfg, |p| {
+            if p.phase == ProvingPhase::K2Pow {
+                passes += 1;
+            }
+        })
+        .unwrap_err();
+        assert_eq!(2, passes);
+        assert!(err.to_string().contains("2 passes"), "{err}");
+    }
+
+    #[test]
+    fn streaming_proof_generation() {
+        let challenge = b"hello world, CHALLENGE me!!!!!!!";
+        let (datadir, data, metadata) = pos_data(512 * 1024);
+
+        let mut events = Vec::new();
+        let proof = generate_proof_streaming(datadir.path(), challenge, proving_config(), |p| {
+            events.push(*p)
+        })
+        .unwrap();
+        assert_eq!(
+            proof,
+            generate_proof(datadir.path(), challenge, proving_config()).unwrap()
+        );
+
+        let cfg = proving_config();
+        assert_eq!(ProvingPhase::K2Pow, events[0].phase);
+        let last = events.last().unwrap();
+        assert_eq!(ProvingPhase::K3Pow, last.phase);
+        assert_eq!(cfg.k2 as usize, last.indices_found);
+        assert!(proof.nonce < last.nonces_tried);
+        for event in &events {
+            assert_eq!(0, event.nonces_tried % cfg.n);
+            if event.phase == ProvingPhase::Searching {
+                assert!(event.indices_found < cfg.k2 as usize);
+            }
+        }
+
+        let labels = labels_for(&data, &proof);
+        assert_eq!(
+            Ok(()),
+            verify_with_labels(
+                challenge,
+                &proof,
+                &metadata,
+                &cfg,
+                &labels,
+                &VerifyConfig::default()
+            )
+        );
+    }
+
+    #[test]
+    fn proving_for_files() {
+        let challenge = b"hello world, CHALLENGE me!!!!!!!";
+        let (datadir, data, metadata) = pos_data(512 * 1024);
+
+        let proof =
+            generate_proof_for_files(datadir.path(), challenge, proving_config(), &[1]).unwrap();
+        let first_index = metadata.max_file_size / 16;
+        assert!(proof.indicies.iter().all(|&i| i >= first_index));
+
+        let labels = labels_for(&data, &proof);
+        assert_eq!(
+            Ok(()),
+            verify_with_labels(
+                challenge,
+                &proof,
+                &metadata,
+                &proving_config(),
+                &labels,
+                &VerifyConfig::default()
+            )
+        );
+
+        assert!(
+            generate_proof_for_files(datadir.path(), challenge, proving_config(), &[2]).is_err()
+        );
+    }
+
+    #[test]
+    fn cancelling_proof_generation() {
+        let challenge = b"hello world, CHALLENGE me!!!!!!!";
+        let (datadir, data, metadata) = pos_data(512 * 1024);
+
+        let stop = AtomicBool::new(true);
+        let err = generate_proof_cancellable(datadir.path(), challenge, proving_config(), &stop)
+            .unwrap_err();
+        assert_eq!(Some(&Cancelled), err.downcast_ref::<Cancelled>());
+
+        stop.store(false, Ordering::Relaxed);
+        let proof =
+            generate_proof_cancellable(datadir.path(), challenge, proving_config(), &stop).unwrap();
+        let labels = labels_for(&data, &proof);
+        assert_eq!(
+            Ok(()),
+            verify_with_labels(
+                challenge,
+                &proof,
+                &metadata,
+                &proving_config(),
+                &labels,
+                &VerifyConfig::default()
+            )
+        );
+    }
+
+    #[test]
+    fn proving_partial() {
+        let challenge = b"hello world, CHALLENGE me!!!!!!!";
+        let (datadir, data, _) = pos_data(512 * 1024);
+
+        let partial =
+            generate_partial_proof(datadir.path(), challenge, proving_config(), 2).unwrap();
+        assert_eq!(2, partial.metadata.num_units);
+        let max_index = partial.metadata.num_label_blocks();
+        assert!(partial.proof.indicies.iter().all(|&i| i < max_index));
+
+        let labels = labels_for(&data, &partial.proof);
+        assert_eq!(
+            Ok(()),
+            verify_with_labels(
+                challenge,
+                &partial.proof,
+                &partial.metadata,
+                &proving_config(),
+                &labels,
+                &VerifyConfig::default()
+            )
+        );
+
+        assert!(generate_partial_proof(datadir.path(), challenge, proving_config(), 0).is_err());
+        assert!(generate_partial_proof(datadir.path(), challenge, proving_config(), 5).is_err());
+    }
+
+    #[test]
+    fn proving_with_external_k2_pows() {
+        let challenge = b"hello world, CHALLENGE me!!!!!!!";
+        let (datadir, data, metadata) = pos_data(128 * 1024);
+
+        let cfg = proving_config();
+        let k2_pows = (0..cfg.n / 2)
+            .map(|group| find_k2_pow(challenge, group, pow_scrypt_params(), cfg.k2_pow_difficulty))
+            .collect::<Vec<_>>();
+        let proof =
+            generate_proof_with_k2_pows(datadir.path(), challenge, proving_config(), &k2_pows)
+                .unwrap();
+        assert_eq!(k2_pows[proof.nonce as usize / 2], proof.k2_pow);
+
+        let labels = labels_for(&data, &proof);
+        assert_eq!(
+            Ok(()),
+            verify_with_labels(
+                challenge,
+                &proof,
+                &metadata,
+                &cfg,
+                &labels,
+                &VerifyConfig::default()
+            )
+        );
+    }
 }
@@ -1,18 +1,30 @@
 use std::{
+    ffi::OsString,
     fs::{DirEntry, File},
-    io::Read,
-    path::Path,
+    io::{self, Read, Seek, SeekFrom, Take},
+    path::{Path, PathBuf},
+    sync::mpsc,
+    thread,
+    time::{Duration, Instant},
 };
 
-use itertools::Itertools;
+use eyre::Context;
+use itertools::{Either, Itertools};
+use rayon::prelude::{IntoParallelRefIterator, ParallelIterator};
 use regex::Regex;
 
+use crate::{
+    config::OversizedFiles,
+    metadata::{self, PostMetadata, LABELS_BLOCK_SIZE},
+};
+
 #[derive(Debug, PartialEq, Eq)]
 pub struct Batch {
     pub data: Vec<u8>,
     pub index: u64,
 }
 
+/// Reads data in batches. It stops after the first read error, which it yields.
 pub struct BatchingReader<T>
 where
     T: Read,
@@ -20,6 +32,7 @@ where
     reader: T,
     index: u64,
     batch_size: usize,
+    failed: bool,
 }
 
 impl<T: Read> BatchingReader<T> {
@@ -28,14 +41,18 @@ impl<T: Read> BatchingReader<T> {
             reader,
             index,
             batch_size,
+            failed: false,
         }
     }
 }
 
 impl<T: Read> Iterator for BatchingReader<T> {
-    type Item = Batch;
+    type Item = io::Result<Batch>;
 
     fn next(&mut self) -> Option<Self::Item> {
+        if self.failed {
+            return None;
+        }
         // FIXME(brozansk) avoid reallocating the vector
         let mut data = Vec::with_capacity(self.batch_size);
         match self
@@ -51,15 +68,20 @@ impl<T: Read> Iterator for BatchingReader<T> {
                     index: self.index,
                 };
                 self.index += n as u64;
-                Some(batch)
+                Some(Ok(batch))
+            }
+            Err(e) => {
+                self.failed = true;
+                Some(Err(e))
             }
-            Err(_) => None,
         }
     }
 }
 
-fn pos_files(datadir: &Path) -> impl Iterator<Item = DirEntry> {
-    let file_re = Regex::new(r"postdata_\d+\.bin").unwrap();
+/// POS data files in the directory along with their index `N` in `postdata_N.bin`,
+/// ordered by the index.
+pub(crate) fn pos_files(datadir: &Path) -> impl Iterator<Item = (usize, DirEntry)> {
+    let file_re = Regex::new(r"postdata_(\d+)\.bin").unwrap();
     datadir
         .read_dir()
         .expect("read_dir call failed")
@@ -67,33 +89,863 @@ fn pos_files(datadir: &Path) -> impl Iterator<Item = DirEntry> {
             Ok(entry) => Some(entry),
             Err(_) => None,
         })
-        .filter(|entry| file_re.is_match(entry.path().to_str().unwrap()))
-        .sorted_by_key(|entry| entry.path())
+        .filter_map(move |entry| {
+            let name = entry.file_name();
+            let index = file_re.captures(name.to_str()?)?[1].parse().ok()?;
+            Some((index, entry))
+        })
+        .sorted_by_key(|(index, _)| *index)
 }
 
+/// Read all POS data in batches.
+///
+/// # Panics
+/// If the data can't be opened or read.
 pub fn read_data(datadir: &Path, batch_size: usize) -> impl Iterator<Item = Batch> {
+    open_pos_files(datadir, batch_size, None, None, |_| true, |file, _| file)
+        .expect("opening POS data")
+        .map(|batch| batch.expect("reading POS data"))
+}
+
+/// Read the batches on a separate thread of the `scope`, up to `depth` batches ahead
+/// of the consumer. With 0 `depth` the batches are read as they're consumed.
+pub(crate) fn read_ahead<'scope, I, T>(
+    scope: &'scope thread::Scope<'scope, '_>,
+    batches: I,
+    depth: usize,
+) -> impl Iterator<Item = T> + 'scope
+where
+    I: Iterator<Item = T> + Send + 'scope,
+    T: Send + 'scope,
+{
+    if depth == 0 {
+        return Either::Left(batches);
+    }
+    let (tx, rx) = mpsc::sync_channel(depth);
+    scope.spawn(move || {
+        for batch in batches {
+            // The consumer is gone, e.g. because it found a proof.
+            if tx.send(batch).is_err() {
+                break;
+            }
+        }
+    });
+    Either::Right(rx.into_iter())
+}
+
+/// A single read of POS data.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct ReadTrace {
+    /// Position of the read in the whole POS data.
+    pub offset: u64,
+    /// Number of bytes read.
+    pub len: usize,
+    pub latency: Duration,
+}
+
+/// Reads a file, reporting every read to `trace`.
+pub struct TracedFile<R, F> {
+    reader: R,
+    offset: u64,
+    trace: F,
+}
+
+impl<R, F> TracedFile<R, F> {
+    /// `offset` is the position of the file in the whole POS data.
+    pub fn new(reader: R, offset: u64, trace: F) -> Self {
+        Self {
+            reader,
+            offset,
+            trace,
+        }
+    }
+}
+
+impl<R: Read, F: Fn(&ReadTrace)> Read for TracedFile<R, F> {
+    fn read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+        let start = Instant::now();
+        let len = self.reader.read(buf)?;
+        (self.trace)(&ReadTrace {
+            offset: self.offset,
+            len,
+            latency: start.elapsed(),
+        });
+        self.offset += len as u64;
+        Ok(len)
+    }
+}
+
+/// Like [read_data], but calls `trace` for every read issued to the files.
+///
+/// Use [read_data] when not tracing, it doesn't measure anything.
+pub fn read_data_traced<F>(
+    datadir: &Path,
+    batch_size: usize,
+    trace: F,
+) -> impl Iterator<Item = Batch>
+where
+    F: Fn(&ReadTrace) + Clone,
+{
+    open_pos_files(
+        datadir,
+        batch_size,
+        None,
+        None,
+        |_| true,
+        move |file, offset| TracedFile::new(file, offset, trace.clone()),
+    )
+    .expect("opening POS data")
+    .map(|batch| batch.expect("reading POS data"))
+}
+
+/// Throughput of reading the POS data in batches of `batch_size` bytes.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct ReadThroughput {
+    pub batch_size: usize,
+    /// Bytes read per second.
+    pub bytes_per_sec: f64,
+}
+
+/// Measure the throughput of reading up to `max_bytes` of the POS data in batches of every
+/// size in `sizes`, e.g. to pick [Config::read_batch_size](crate::config::Config::read_batch_size)
+/// for the storage at hand.
+///
+/// The same data is read for every size, so later sizes might be served from the page cache.
+/// Make `max_bytes` larger than the memory of the machine, or drop the caches in between,
+/// for the results to reflect the storage.
+pub fn measure_read_throughput(
+    datadir: &Path,
+    sizes: &[usize],
+    max_bytes: u64,
+) -> eyre::Result<Vec<ReadThroughput>> {
+    sizes
+        .iter()
+        .map(|&batch_size| {
+            eyre::ensure!(batch_size > 0, "batch size must be > 0");
+            let start = Instant::now();
+            let mut read = 0;
+            for batch in open_pos_files(datadir, batch_size, None, None, |_| true, |file, _| file)?
+            {
+                read += batch.wrap_err("reading POS data")?.data.len() as u64;
+                if read >= max_bytes {
+                    break;
+                }
+            }
+            Ok(ReadThroughput {
+                batch_size,
+                bytes_per_sec: read as f64 / start.elapsed().as_secs_f64(),
+            })
+        })
+        .collect()
+}
+
+/// Expected size of the `postdata_{index}.bin` file.
+///
+/// All files but the last hold `max_file_size` bytes, files past the last one hold nothing.
+pub fn expected_file_size(index: usize, metadata: &PostMetadata) -> u64 {
+    let start = index as u64 * metadata.max_file_size;
+    metadata
+        .total_size()
+        .saturating_sub(start)
+        .min(metadata.max_file_size)
+}
+
+/// Open all POS data files for reading in batches, wrapping every file with `wrap`
+/// along with its position in the whole data.
+///
+/// If `layout` is given, files larger than its metadata declares are handled
+/// according to its policy.
+///
+/// If `checksums` are given, every file is checked against its checksum
+/// once read to the end, see [ChecksummedFile].
+///
+/// Only files with an index for which `include` returns true are read.
+/// The others are skipped, but still count for the positions of the following files.
+pub(crate) fn open_pos_files<R, I, W>(
+    datadir: &Path,
+    batch_size: usize,
+    layout: Option<(&PostMetadata, OversizedFiles)>,
+    checksums: Option<&[Vec<u8>]>,
+    include: I,
+    wrap: W,
+) -> eyre::Result<impl Iterator<Item = io::Result<Batch>>>
+where
+    R: Read,
+    I: Fn(usize) -> bool,
+    W: Fn(Take<File>, u64) -> R,
+{
+    let files = pos_files(datadir).collect_vec();
+    if let Some(checksums) = checksums {
+        check_file_count(checksums, files.len())?;
+    }
     let mut pos = 0;
-    let mut readers = Vec::<BatchingReader<File>>::new();
-    for entry in pos_files(datadir) {
-        let file = File::open(entry.path()).unwrap();
-        let len = file.metadata().unwrap().len();
-        readers.push(BatchingReader::new(file, pos, batch_size));
+    let mut readers = Vec::<BatchingReader<ChecksummedFile<R>>>::new();
+    for (index, entry) in files {
+        let path = entry.path();
+        let mut len = entry
+            .metadata()
+            .wrap_err_with(|| format!("reading metadata of {path:?}"))?
+            .len();
+        if let Some((metadata, policy)) = layout {
+            len = size_to_read(&path, len, expected_file_size(index, metadata), policy)?;
+        }
+        if include(index) {
+            let file = File::open(&path).wrap_err_with(|| format!("opening {path:?}"))?;
+            let file = wrap(file.take(len), pos);
+            readers.push(BatchingReader::new(
+                ChecksummedFile::new(file, index, file_checksum_in(checksums, index)),
+                pos,
+                batch_size,
+            ));
+        }
         pos += len
     }
 
-    readers.into_iter().flatten()
+    Ok(readers.into_iter().flatten())
+}
+
+/// Reads a `postdata_N.bin` file, checking what was read against the checksum of the file
+/// once the end is reached.
+///
+/// On a mismatch, the read reaching the end fails with a [ReadError::Corrupt]
+/// inside the [io::Error].
+pub(crate) struct ChecksummedFile<R> {
+    reader: R,
+    file: usize,
+    /// The expected checksum and the hash of the data read so far, unless not checking.
+    check: Option<(Vec<u8>, blake3::Hasher)>,
+}
+
+impl<R> ChecksummedFile<R> {
+    /// `file` is the index `N` of the file. Nothing is checked without a `checksum`.
+    pub(crate) fn new(reader: R, file: usize, checksum: Option<Vec<u8>>) -> Self {
+        Self {
+            reader,
+            file,
+            check: checksum.map(|checksum| (checksum, blake3::Hasher::new())),
+        }
+    }
+}
+
+impl<R: Read> Read for ChecksummedFile<R> {
+    fn read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+        let n = self.reader.read(buf)?;
+        let Some((checksum, hasher)) = &mut self.check else {
+            return Ok(n);
+        };
+        if n > 0 || buf.is_empty() {
+            hasher.update(&buf[..n]);
+            return Ok(n);
+        }
+        let corrupt = hasher.finalize().as_bytes() != checksum.as_slice();
+        self.check = None;
+        if corrupt {
+            let err = ReadError::Corrupt { file: self.file };
+            return Err(io::Error::new(io::ErrorKind::InvalidData, err));
+        }
+        Ok(0)
+    }
+}
+
+/// The checksum of the `postdata_{file}.bin` file, if checking the files at all.
+///
+/// A file past the last checksum never matches.
+fn file_checksum_in(checksums: Option<&[Vec<u8>]>, file: usize) -> Option<Vec<u8>> {
+    checksums.map(|checksums| checksums.get(file).cloned().unwrap_or_default())
+}
+
+/// Number of bytes to read of the file at `path` holding `len` bytes, `expected` by the
+/// metadata, handling oversized files according to the `policy`.
+fn size_to_read(path: &Path, len: u64, expected: u64, policy: OversizedFiles) -> eyre::Result<u64> {
+    if len <= expected {
+        return Ok(len);
+    }
+    match policy {
+        OversizedFiles::Error => {
+            eyre::bail!("{path:?} holds {len}B, more than the expected {expected}B")
+        }
+        OversizedFiles::Truncate => Ok(expected),
+        OversizedFiles::Ignore => {
+            log::warn!("{path:?} holds {len}B, more than the expected {expected}B");
+            Ok(len)
+        }
+    }
+}
+
+/// Reads a file, falling back to copies of it on read errors.
+///
+/// On failure, the next copy is opened and reading continues
+/// from the same position. A copy ending before `len` bytes is a failure too.
+pub struct MirroredFile {
+    /// The same file in every mirror, primary first.
+    paths: Vec<PathBuf>,
+    current: usize,
+    file: Option<Take<File>>,
+    position: u64,
+    len: u64,
+}
+
+impl MirroredFile {
+    /// Read the first `len` bytes of the file from the first copy in `paths` that can be read.
+    pub fn new(paths: Vec<PathBuf>, len: u64) -> Self {
+        Self {
+            paths,
+            current: 0,
+            file: None,
+            position: 0,
+            len,
+        }
+    }
+
+    fn try_read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+        if self.file.is_none() {
+            let mut file = File::open(&self.paths[self.current])?;
+            file.seek(SeekFrom::Start(self.position))?;
+            self.file = Some(file.take(self.len - self.position));
+        }
+        let n = self.file.as_mut().expect("file opened above").read(buf)?;
+        if n == 0 && !buf.is_empty() && self.position < self.len {
+            return Err(io::ErrorKind::UnexpectedEof.into());
+        }
+        Ok(n)
+    }
+}
+
+impl Read for MirroredFile {
+    fn read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+        loop {
+            match self.try_read(buf) {
+                Ok(n) => {
+                    self.position += n as u64;
+                    return Ok(n);
+                }
+                Err(e) if e.kind() == io::ErrorKind::Interrupted => {}
+                Err(e) => {
+                    let Some(fallback) = self.paths.get(self.current + 1) else {
+                        return Err(e);
+                    };
+                    log::warn!(
+                        "reading {} failed: {e}, falling back to {}",
+                        self.paths[self.current].display(),
+                        fallback.display()
+                    );
+                    self.current += 1;
+                    self.file = None;
+                }
+            }
+        }
+    }
+}
+
+/// Check if two datasets hold the same labels in the same layout.
+fn same_layout(a: &PostMetadata, b: &PostMetadata) -> bool {
+    a.node_id == b.node_id
+        && a.commitment_atx_id == b.commitment_atx_id
+        && a.bits_per_label == b.bits_per_label
+        && a.labels_per_unit == b.labels_per_unit
+        && a.num_units == b.num_units
+        && a.max_file_size == b.max_file_size
+}
+
+/// Load the metadata of POS data mirrored in `datadirs` from the first of them
+/// holding metadata that can be loaded.
+///
+/// All directories with such metadata must hold the same dataset. A directory whose
+/// metadata is missing or broken is still read from, as declared by the others.
+pub fn load_mirrored_metadata(datadirs: &[&Path]) -> eyre::Result<PostMetadata> {
+    eyre::ensure!(!datadirs.is_empty(), "no data directories given");
+    let mut expected: Option<(&Path, PostMetadata)> = None;
+    for &datadir in datadirs {
+        let metadata = match metadata::load(datadir) {
+            Ok(metadata) => metadata,
+            Err(e) => {
+                log::warn!("can't load metadata of {}: {e:#}", datadir.display());
+                continue;
+            }
+        };
+        match &expected {
+            Some((first, expected)) => eyre::ensure!(
+                same_layout(expected, &metadata),
+                "{} holds different data than {}",
+                datadir.display(),
+                first.display()
+            ),
+            None => expected = Some((datadir, metadata)),
+        }
+    }
+    expected
+        .map(|(_, metadata)| metadata)
+        .ok_or_else(|| eyre::eyre!("no data directory holds metadata that can be loaded"))
+}
+
+/// Read POS data from the first of `datadirs`, falling back to the others
+/// (in order) when reading a file fails.
+///
+/// All directories must hold the same dataset, see [load_mirrored_metadata].
+/// A file is as large as its largest copy, shorter copies fail reading past their end.
+/// Files larger than the metadata declares are handled according to `on_oversized_file`.
+/// Yields an error and stops if a file can't be read from any of them.
+pub fn read_data_mirrored(
+    datadirs: &[&Path],
+    batch_size: usize,
+    on_oversized_file: OversizedFiles,
+) -> eyre::Result<impl Iterator<Item = io::Result<Batch>>> {
+    let metadata = load_mirrored_metadata(datadirs)?;
+    open_mirrored_files(datadirs, &metadata, batch_size, on_oversized_file)
+}
+
+/// Open the POS data files mirrored in `datadirs` for reading in batches,
+/// see [read_data_mirrored].
+///
+/// If `checksums` are given, every file is checked against its checksum once read
+/// to the end, as in [open_pos_files]. The copies in `skip` aren't read.
+pub(crate) fn open_mirrored_files(
+    datadirs: &[&Path],
+    metadata: &PostMetadata,
+    batch_size: usize,
+    on_oversized_file: OversizedFiles,
+    checksums: Option<&[Vec<u8>]>,
+    skip: &[PathBuf],
+) -> eyre::Result<impl Iterator<Item = io::Result<Batch>>> {
+    // A file missing in some of the directories can still be read from the others.
+    let names: Vec<(usize, OsString)> = datadirs
+        .iter()
+        .filter(|dir| dir.is_dir())
+        .flat_map(|dir| pos_files(dir))
+        .map(|(index, entry)| (index, entry.file_name()))
+        .sorted()
+        .dedup()
+        .collect();
+    if let Some(checksums) = checksums {
+        check_file_count(checksums, names.len())?;
+    }
+
+    let mut pos = 0;
+    let mut readers = Vec::<BatchingReader<ChecksummedFile<MirroredFile>>>::new();
+    for (index, name) in names {
+        let paths: Vec<PathBuf> = datadirs
+            .iter()
+            .map(|dir| dir.join(&name))
+            .filter(|path| !skip.contains(path))
+            .collect();
+        eyre::ensure!(!paths.is_empty(), "no copy of {name:?} is left to read");
+        let expected = expected_file_size(index, metadata);
+        // Without any copy to tell the size, reading fails on every copy anyway.
+        let (len, path) = paths
+            .iter()
+            .filter_map(|path| Some((path.metadata().ok().filter(|m| m.is_file())?.len(), path)))
+            .max_by_key(|(len, _)| *len)
+            .unwrap_or((expected, &paths[0]));
+        let len = size_to_read(path, len, expected, on_oversized_file)?;
+        readers.push(BatchingReader::new(
+            ChecksummedFile::new(
+                MirroredFile::new(paths, len),
+                index,
+                file_checksum_in(checksums, index),
+            ),
+            pos,
+            batch_size,
+        ));
+        pos += len;
+    }
+
+    Ok(readers.into_iter().flatten())
+}
+
+/// Find the copies of the `postdata_{file}.bin` file in `datadirs` that don't match
+/// its checksum in the metadata or can't be read, reading as much of every copy
+/// as [open_mirrored_files] does.
+pub(crate) fn corrupt_copies(
+    datadirs: &[&Path],
+    metadata: &PostMetadata,
+    file: usize,
+    on_oversized_file: OversizedFiles,
+) -> Vec<PathBuf> {
+    let Some(checksum) = metadata.checksums.as_ref().and_then(|c| c.get(file)) else {
+        return Vec::new();
+    };
+    let limit = match on_oversized_file {
+        OversizedFiles::Truncate => expected_file_size(file, metadata),
+        _ => u64::MAX,
+    };
+    datadirs
+        .iter()
+        .map(|dir| dir.join(format!("postdata_{file}.bin")))
+        .filter(|path| path.is_file())
+        .filter(|path| {
+            let mut hasher = blake3::Hasher::new();
+            let read =
+                File::open(path).and_then(|file| io::copy(&mut file.take(limit), &mut hasher));
+            read.is_err() || hasher.finalize().as_bytes() != checksum.as_slice()
+        })
+        .collect()
+}
+
+#[derive(Debug)]
+pub enum ReadError {
+    /// The `postdata_{file}.bin` file doesn't match its checksum.
+    Corrupt {
+        file: usize,
+    },
+    /// The number of files doesn't match the number of checksums.
+    FileCountMismatch {
+        expected: usize,
+        got: usize,
+    },
+    Io(io::Error),
+}
+
+impl From<io::Error> for ReadError {
+    fn from(err: io::Error) -> Self {
+        ReadError::Io(err)
+    }
+}
+
+impl std::fmt::Display for ReadError {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            ReadError::Corrupt { file } => write!(f, "postdata_{file}.bin is corrupt"),
+            ReadError::FileCountMismatch { expected, got } => {
+                write!(f, "expected {expected} POS data files, got {got}")
+            }
+            ReadError::Io(err) => write!(f, "reading POS data: {err}"),
+        }
+    }
+}
+
+impl std::error::Error for ReadError {}
+
+/// Compute the checksum of a POS data file.
+pub fn file_checksum(path: &Path) -> io::Result<Vec<u8>> {
+    let mut hasher = blake3::Hasher::new();
+    io::copy(&mut File::open(path)?, &mut hasher)?;
+    Ok(hasher.finalize().as_bytes().to_vec())
+}
+
+/// Compute the checksums of all POS data files, to be stored in the metadata.
+pub fn compute_checksums(datadir: &Path) -> io::Result<Vec<Vec<u8>>> {
+    pos_files(datadir)
+        .map(|(_, entry)| file_checksum(&entry.path()))
+        .collect()
+}
+
+/// Check the POS data files against the checksums in the metadata.
+///
+/// Passes if the metadata holds no checksums, as for datasets initialized without them.
+/// Proving checks the files as it reads them instead, see
+/// [Config::verify_checksums](crate::config::Config::verify_checksums).
+pub fn verify_checksums(datadir: &Path, metadata: &PostMetadata) -> Result<(), ReadError> {
+    let Some(checksums) = &metadata.checksums else {
+        return Ok(());
+    };
+    check_file_count(checksums, pos_files(datadir).count())?;
+    for (file, checksum) in checksums.iter().enumerate() {
+        let path = datadir.join(format!("postdata_{file}.bin"));
+        if &file_checksum(&path)? != checksum {
+            return Err(ReadError::Corrupt { file });
+        }
+    }
+    Ok(())
+}
+
+fn check_file_count(checksums: &[Vec<u8>], files: usize) -> Result<(), ReadError> {
+    if files != checksums.len() {
+        return Err(ReadError::FileCountMismatch {
+            expected: checksums.len(),
+            got: files,
+        });
+    }
+    Ok(())
+}
+
+/// The label with the smallest value in the POS data, the nonce stored in the metadata.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct VrfNonce {
+    /// Index of the label in the whole POS data.
+    pub index: u64,
+    pub label: Vec<u8>,
+}
+
+impl VrfNonce {
+    /// Whether the label is below `target`, compared byte by byte like labels are
+    /// when searching for the nonce.
+    pub fn is_below(&self, target: &[u8]) -> bool {
+        self.label.as_slice() < target
+    }
+}
+
+/// Read the label at the VRF nonce stored in the metadata, e.g. to find out why the nonce
+/// isn't accepted anymore after the target changed.
+pub fn read_vrf_nonce(datadir: &Path) -> eyre::Result<VrfNonce> {
+    let metadata = metadata::load(datadir).wrap_err("loading metadata")?;
+    let index = metadata
+        .nonce
+        .ok_or_else(|| eyre::eyre!("the metadata has no VRF nonce"))?;
+    let label = read_label(datadir, &metadata, index)?;
+    Ok(VrfNonce { index, label })
+}
+
+/// Find the [VrfNonce] by scanning the POS data files, e.g. to restore lost metadata.
+///
+/// Labels are compared byte by byte, the first one wins a tie. The files are scanned
+/// in parallel. A trailing part of a file too short to hold a label is ignored.
+pub fn find_vrf_nonce(datadir: &Path, bits_per_label: u8) -> eyre::Result<Option<VrfNonce>> {
+    eyre::ensure!(
+        bits_per_label > 0 && bits_per_label % 8 == 0,
+        "bits per label must be a positive multiple of 8, got {bits_per_label}"
+    );
+    let label_size = bits_per_label as usize / 8;
+
+    // The index of the first label in every file depends on the sizes of the ones before.
+    let mut first_label = 0;
+    let mut files = Vec::new();
+    for (_, entry) in pos_files(datadir) {
+        let len = entry.metadata()?.len();
+        files.push((first_label, entry.path()));
+        first_label += len / label_size as u64;
+    }
+
+    let nonces = files
+        .par_iter()
+        .map(|(first_label, path)| {
+            scan_for_vrf_nonce(path, *first_label, label_size)
+                .wrap_err_with(|| format!("scanning {path:?}"))
+        })
+        .collect::<eyre::Result<Vec<_>>>()?;
+    // Files are in order, so taking the first minimum keeps the lowest index on a tie.
+    Ok(nonces.into_iter().flatten().reduce(|best, nonce| {
+        if nonce.label < best.label {
+            nonce
+        } else {
+            best
+        }
+    }))
+}
+
+fn scan_for_vrf_nonce(
+    path: &Path,
+    first_label: u64,
+    label_size: usize,
+) -> io::Result<Option<VrfNonce>> {
+    let read_size = label_size * 64 * 1024;
+    let mut file = File::open(path)?;
+    let mut buf = Vec::with_capacity(read_size);
+    let mut best: Option<VrfNonce> = None;
+    let mut index = first_label;
+    loop {
+        buf.clear();
+        (&mut file).take(read_size as u64).read_to_end(&mut buf)?;
+        for label in buf.chunks_exact(label_size) {
+            if best
+                .as_ref()
+                .map_or(true, |best| label < best.label.as_slice())
+            {
+                best = Some(VrfNonce {
+                    index,
+                    label: label.to_vec(),
+                });
+            }
+            index += 1;
+        }
+        if buf.len() < read_size {
+            return Ok(best);
+        }
+    }
+}
+
+/// The VRF nonce of POS data initialized in parts doesn't check out,
+/// see [validate_merged_nonce].
+#[derive(Debug)]
+pub enum MergeError {
+    /// The metadata has no nonce.
+    NoNonce,
+    /// The nonce in the metadata isn't one found by any part.
+    UnknownNonce {
+        nonce: u64,
+    },
+    /// The label at `better`, found by another part, is smaller than the one at `nonce`.
+    NotMinimal {
+        nonce: u64,
+        better: u64,
+    },
+    Read(eyre::Report),
+}
+
+impl std::fmt::Display for MergeError {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            MergeError::NoNonce => write!(f, "the metadata has no VRF nonce"),
+            MergeError::UnknownNonce { nonce } => {
+                write!(f, "VRF nonce {nonce} wasn't found by any part")
+            }
+            MergeError::NotMinimal { nonce, better } => {
+                write!(f, "VRF nonce {nonce} isn't minimal, {better} is better")
+            }
+            MergeError::Read(err) => write!(f, "reading labels: {err:#}"),
+        }
+    }
+}
+
+impl std::error::Error for MergeError {}
+
+/// Check the VRF nonce in the metadata of POS data initialized in parts, e.g. on
+/// multiple machines, against the nonces the parts found on their own.
+///
+/// `parts` holds the index of the [VrfNonce] found in every part. The labels at them
+/// are read again from the data, and the nonce in the metadata must be the one with
+/// the smallest label, the lowest index winning a tie as in [find_vrf_nonce].
+/// Returns the nonce.
+pub fn validate_merged_nonce(
+    datadir: &Path,
+    metadata: &PostMetadata,
+    parts: &[u64],
+) -> Result<u64, MergeError> {
+    let nonce = metadata.nonce.ok_or(MergeError::NoNonce)?;
+    if !parts.contains(&nonce) {
+        return Err(MergeError::UnknownNonce { nonce });
+    }
+
+    let mut best: Option<VrfNonce> = None;
+    for &index in parts {
+        let label = read_label(datadir, metadata, index).map_err(MergeError::Read)?;
+        if best.as_ref().map_or(true, |best| {
+            (label.as_slice(), index) < (best.label.as_slice(), best.index)
+        }) {
+            best = Some(VrfNonce { index, label });
+        }
+    }
+    match best {
+        Some(best) if best.index != nonce => Err(MergeError::NotMinimal {
+            nonce,
+            better: best.index,
+        }),
+        _ => Ok(nonce),
+    }
+}
+
+/// Find where the block of labels at the given proof index starts.
+///
+/// Returns the index `N` of the `postdata_N.bin` file and the byte offset within it.
+/// All files but the last are `max_file_size` bytes long, so a block of labels
+/// might continue in the next file if the file size isn't a multiple of the block size.
+///
+/// # Panics
+/// If `max_file_size` in the metadata is 0.
+pub fn index_to_location(index: u64, metadata: &PostMetadata) -> (usize, u64) {
+    position_to_location(index * LABELS_BLOCK_SIZE as u64, metadata)
+}
+
+/// Like [index_to_location], but for the byte at `position` in the whole POS data.
+fn position_to_location(position: u64, metadata: &PostMetadata) -> (usize, u64) {
+    (
+        (position / metadata.max_file_size) as usize,
+        position % metadata.max_file_size,
+    )
+}
+
+/// Read the blocks of labels at the given proof indices.
+pub fn read_labels(
+    datadir: &Path,
+    metadata: &PostMetadata,
+    indices: &[u64],
+) -> eyre::Result<Vec<[u8; LABELS_BLOCK_SIZE]>> {
+    eyre::ensure!(metadata.max_file_size > 0, "max file size must be > 0");
+    indices
+        .iter()
+        .map(|&index| {
+            read_label_block(datadir, metadata, index)
+                .wrap_err_with(|| format!("reading labels at index {index}"))
+        })
+        .collect()
+}
+
+fn read_label_block(
+    datadir: &Path,
+    metadata: &PostMetadata,
+    index: u64,
+) -> eyre::Result<[u8; LABELS_BLOCK_SIZE]> {
+    let mut block = [0u8; LABELS_BLOCK_SIZE];
+    read_at(
+        datadir,
+        metadata,
+        index_to_location(index, metadata),
+        &mut block,
+    )?;
+    Ok(block)
+}
+
+/// Read the label at the given index, `bits_per_label / 8` bytes long.
+pub fn read_label(datadir: &Path, metadata: &PostMetadata, index: u64) -> eyre::Result<Vec<u8>> {
+    eyre::ensure!(metadata.max_file_size > 0, "max file size must be > 0");
+    let bits_per_label = metadata.bits_per_label;
+    eyre::ensure!(
+        bits_per_label > 0 && bits_per_label % 8 == 0,
+        "bits per label must be a positive multiple of 8, got {bits_per_label}"
+    );
+    let mut label = vec![0u8; bits_per_label as usize / 8];
+    let location = position_to_location(index * label.len() as u64, metadata);
+    read_at(datadir, metadata, location, &mut label)
+        .wrap_err_with(|| format!("reading label at index {index}"))?;
+    Ok(label)
+}
+
+/// Fill `buf` with the POS data starting at the `location` in a file
+/// (see [index_to_location]), reading across files if needed.
+fn read_at(
+    datadir: &Path,
+    metadata: &PostMetadata,
+    location: (usize, u64),
+    buf: &mut [u8],
+) -> eyre::Result<()> {
+    let (mut file_index, mut offset) = location;
+    let mut filled = 0;
+    while filled < buf.len() {
+        let path = datadir.join(format!("postdata_{file_index}.bin"));
+        let mut file = File::open(&path).wrap_err_with(|| format!("opening {path:?}"))?;
+        file.seek(SeekFrom::Start(offset))?;
+        let len = (buf.len() - filled).min((metadata.max_file_size - offset) as usize);
+        file.read_exact(&mut buf[filled..filled + len])?;
+        filled += len;
+        file_index += 1;
+        offset = 0;
+    }
+    Ok(())
 }
 
 #[cfg(test)]
 mod tests {
     use std::io::Write;
+    use std::sync::{Arc, Mutex};
     use std::{fs::File, io::Cursor};
 
     use tempfile::tempdir;
 
-    use crate::reader::{Batch, BatchingReader};
+    use crate::{
+        config::OversizedFiles,
+        metadata::PostMetadata,
+        reader::{Batch, BatchingReader, ReadTrace},
+    };
 
-    use super::read_data;
+    use super::{
+        compute_checksums, expected_file_size, find_vrf_nonce, index_to_location,
+        load_mirrored_metadata, measure_read_throughput, open_pos_files, read_data,
+        read_data_mirrored, read_data_traced, read_labels, read_vrf_nonce, validate_merged_nonce,
+        verify_checksums, MergeError, ReadError, VrfNonce,
+    };
+
+    fn metadata(max_file_size: u64) -> PostMetadata {
+        PostMetadata {
+            node_id: vec![],
+            commitment_atx_id: vec![],
+            bits_per_label: 8,
+            labels_per_unit: 64,
+            num_units: 2,
+            max_file_size,
+            nonce: None,
+            last_position: None,
+            checksums: None,
+        }
+    }
 
     #[test]
     fn batching_reader() {
@@ -105,22 +957,23 @@ mod tests {
                 data: (0..16).collect(),
                 index: 0,
             }),
-            reader.next()
+            reader.next().transpose().unwrap()
         );
         assert_eq!(
             Some(Batch {
                 data: (16..32).collect(),
                 index: 16,
             }),
-            reader.next()
+            reader.next().transpose().unwrap()
         );
         assert_eq!(
             Some(Batch {
                 data: (32..40).collect(),
                 index: 32,
             }),
-            reader.next()
+            reader.next().transpose().unwrap()
         );
+        assert!(reader.next().is_none());
     }
 
     #[test]
@@ -145,6 +998,299 @@ mod tests {
         assert_eq!(expected, result);
     }
 
+    #[test]
+    fn tracing_reads() {
+        let tmp_dir = tempdir().unwrap();
+        let data = ["Hello World!", "Welcome Back"];
+        for (i, part) in data.iter().enumerate() {
+            let file_path = tmp_dir.path().join(format!("postdata_{i}.bin"));
+            let mut tmp_file = File::create(file_path).unwrap();
+            write!(tmp_file, "{part}").unwrap();
+        }
+
+        let traces = Arc::new(Mutex::new(Vec::new()));
+        let batches = read_data_traced(tmp_dir.path(), 5, {
+            let traces = traces.clone();
+            move |trace: &ReadTrace| traces.lock().unwrap().push(*trace)
+        });
+        assert!(batches.eq(read_data(tmp_dir.path(), 5)));
+
+        let traces = traces.lock().unwrap();
+        let mut offset = 0;
+        for trace in traces.iter() {
+            assert_eq!(offset, trace.offset);
+            offset += trace.len as u64;
+        }
+        assert_eq!(24, offset);
+    }
+
+    #[test]
+    fn measuring_read_throughput() {
+        let tmp_dir = tempdir().unwrap();
+        for i in 0..2 {
+            let file_path = tmp_dir.path().join(format!("postdata_{i}.bin"));
+            File::create(file_path)
+                .unwrap()
+                .write_all(&[0; 4096])
+                .unwrap();
+        }
+
+        let results = measure_read_throughput(tmp_dir.path(), &[16, 1024], 6000).unwrap();
+        assert_eq!(
+            vec![16, 1024],
+            results.iter().map(|r| r.batch_size).collect::<Vec<_>>()
+        );
+        assert!(results.iter().all(|r| r.bytes_per_sec > 0.0));
+
+        assert!(measure_read_throughput(tmp_dir.path(), &[0], 6000).is_err());
+    }
+
+    #[test]
+    fn expected_file_sizes() {
+        let metadata = metadata(48);
+        assert_eq!(48, expected_file_size(0, &metadata));
+        assert_eq!(48, expected_file_size(1, &metadata));
+        assert_eq!(32, expected_file_size(2, &metadata));
+        assert_eq!(0, expected_file_size(3, &metadata));
+    }
+
+    #[test]
+    fn handling_oversized_files() {
+        let tmp_dir = tempdir().unwrap();
+        let metadata = metadata(48);
+        let data: Vec<u8> = (0..132).collect();
+        // The middle file holds 4 bytes more than expected.
+        for (i, part) in [&data[..48], &data[48..100], &data[100..]]
+            .iter()
+            .enumerate()
+        {
+            let file_path = tmp_dir.path().join(format!("postdata_{i}.bin"));
+            File::create(file_path).unwrap().write_all(part).unwrap();
+        }
+        let read = |policy| {
+            open_pos_files(
+                tmp_dir.path(),
+                16,
+                Some((&metadata, policy)),
+                None,
+                |_| true,
+                |file, _| file,
+            )
+            .map(|batches| {
+                batches
+                    .flat_map(|batch| batch.unwrap().data)
+                    .collect::<Vec<_>>()
+            })
+        };
+
+        assert!(read(OversizedFiles::Error).is_err());
+        let truncated = [&data[..96], &data[100..]].concat();
+        assert_eq!(truncated, read(OversizedFiles::Truncate).unwrap());
+        assert_eq!(data, read(OversizedFiles::Ignore).unwrap());
+
+        // Files of the expected size are read whole with every policy.
+        std::fs::remove_file(tmp_dir.path().join("postdata_2.bin")).unwrap();
+        std::fs::write(tmp_dir.path().join("postdata_1.bin"), &data[48..96]).unwrap();
+        assert_eq!(data[..96], read(OversizedFiles::Error).unwrap());
+    }
+
+    #[test]
+    fn reading_files_in_index_order() {
+        let tmp_dir = tempdir().unwrap();
+        for i in 0..12u8 {
+            let file_path = tmp_dir.path().join(format!("postdata_{i}.bin"));
+            File::create(file_path).unwrap().write_all(&[i, i]).unwrap();
+        }
+        let data: Vec<u8> = read_data(tmp_dir.path(), 4)
+            .flat_map(|batch| batch.data)
+            .collect();
+        assert_eq!((0..12).flat_map(|i| [i, i]).collect::<Vec<u8>>(), data);
+
+        // Skipped files still count for positions of the following ones.
+        let batches: Vec<Batch> =
+            open_pos_files(tmp_dir.path(), 4, None, None, |i| i == 10, |file, _| file)
+                .unwrap()
+                .collect::<std::io::Result<_>>()
+                .unwrap();
+        assert_eq!(
+            vec![Batch {
+                data: vec![10, 10],
+                index: 20
+            }],
+            batches
+        );
+    }
+
+    #[test]
+    fn verifying_checksums() {
+        let tmp_dir = tempdir().unwrap();
+        for i in 0..3u8 {
+            let file_path = tmp_dir.path().join(format!("postdata_{i}.bin"));
+            File::create(file_path)
+                .unwrap()
+                .write_all(&[i; 48])
+                .unwrap();
+        }
+        let mut metadata = metadata(48);
+        assert!(verify_checksums(tmp_dir.path(), &metadata).is_ok());
+
+        metadata.checksums = Some(compute_checksums(tmp_dir.path()).unwrap());
+        assert!(verify_checksums(tmp_dir.path(), &metadata).is_ok());
+        // Reading checks every file once it's read to the end.
+        let read = || {
+            let checksums = metadata.checksums.as_deref();
+            open_pos_files(
+                tmp_dir.path(),
+                16,
+                None,
+                checksums,
+                |_| true,
+                |file, _| file,
+            )
+            .unwrap()
+            .collect::<Vec<_>>()
+        };
+        assert!(read().iter().all(|batch| batch.is_ok()));
+
+        std::fs::write(tmp_dir.path().join("postdata_1.bin"), [0; 48]).unwrap();
+        assert!(matches!(
+            verify_checksums(tmp_dir.path(), &metadata),
+            Err(ReadError::Corrupt { file: 1 })
+        ));
+        let batches = read();
+        assert_eq!(7, batches.len());
+        assert!(batches[..6].iter().all(|batch| batch.is_ok()));
+        let err = batches[6].as_ref().unwrap_err();
+        assert!(matches!(
+            err.get_ref().unwrap().downcast_ref(),
+            Some(ReadError::Corrupt { file: 1 })
+        ));
+
+        std::fs::remove_file(tmp_dir.path().join("postdata_2.bin")).unwrap();
+        assert!(matches!(
+            verify_checksums(tmp_dir.path(), &metadata),
+            Err(ReadError::FileCountMismatch {
+                expected: 3,
+                got: 2
+            })
+        ));
+    }
+
+    #[test]
+    fn finding_vrf_nonce() {
+        let tmp_dir = tempdir().unwrap();
+        assert_eq!(None, find_vrf_nonce(tmp_dir.path(), 16).unwrap());
+
+        // 2-byte labels in files of 8 labels. The smallest one is in the second file
+        // and repeated in the third, the first occurrence is expected.
+        let mut data = vec![[0xff_u8; 2]; 20];
+        data[13] = [0x01, 0x02];
+        data[15] = [0x01, 0x03];
+        data[17] = [0x01, 0x02];
+        for (i, file) in data.chunks(8).enumerate() {
+            std::fs::write(
+                tmp_dir.path().join(format!("postdata_{i}.bin")),
+                file.concat(),
+            )
+            .unwrap();
+        }
+        assert_eq!(
+            Some(VrfNonce {
+                index: 13,
+                label: vec![0x01, 0x02],
+            }),
+            find_vrf_nonce(tmp_dir.path(), 16).unwrap()
+        );
+
+        assert!(find_vrf_nonce(tmp_dir.path(), 12).is_err());
+    }
+
+    #[test]
+    fn validating_merged_vrf_nonce() {
+        let tmp_dir = tempdir().unwrap();
+        // 2-byte labels in files of 8 labels, split into parts that found 3, 13 and 17.
+        // 13 and 17 have the same label, 13 comes first.
+        let mut data = vec![[0xff_u8; 2]; 20];
+        data[3] = [0x02, 0x00];
+        data[13] = [0x01, 0x02];
+        data[17] = [0x01, 0x02];
+        for (i, file) in data.chunks(8).enumerate() {
+            std::fs::write(
+                tmp_dir.path().join(format!("postdata_{i}.bin")),
+                file.concat(),
+            )
+            .unwrap();
+        }
+        let parts = [3, 13, 17];
+        let merged = |nonce| PostMetadata {
+            bits_per_label: 16,
+            nonce,
+            ..metadata(16)
+        };
+
+        assert_eq!(
+            13,
+            validate_merged_nonce(tmp_dir.path(), &merged(Some(13)), &parts).unwrap()
+        );
+        for (nonce, expected) in [(3, 13), (17, 13)] {
+            assert!(matches!(
+                validate_merged_nonce(tmp_dir.path(), &merged(Some(nonce)), &parts),
+                Err(MergeError::NotMinimal { nonce: n, better }) if n == nonce && better == expected
+            ));
+        }
+        assert!(matches!(
+            validate_merged_nonce(tmp_dir.path(), &merged(Some(5)), &parts),
+            Err(MergeError::UnknownNonce { nonce: 5 })
+        ));
+        assert!(matches!(
+            validate_merged_nonce(tmp_dir.path(), &merged(None), &parts),
+            Err(MergeError::NoNonce)
+        ));
+        // A part claiming a nonce past the data.
+        assert!(matches!(
+            validate_merged_nonce(tmp_dir.path(), &merged(Some(13)), &[13, 40]),
+            Err(MergeError::Read(_))
+        ));
+    }
+
+    #[test]
+    fn reading_vrf_nonce() {
+        let tmp_dir = tempdir().unwrap();
+        let mut data = vec![[0xff_u8; 2]; 20];
+        data[13] = [0x01, 0x02];
+        for (i, file) in data.chunks(8).enumerate() {
+            std::fs::write(
+                tmp_dir.path().join(format!("postdata_{i}.bin")),
+                file.concat(),
+            )
+            .unwrap();
+        }
+        let write_metadata = |nonce| {
+            let metadata = PostMetadata {
+                bits_per_label: 16,
+                nonce,
+                ..metadata(16)
+            };
+            let file = File::create(tmp_dir.path().join("postdata_metadata.json")).unwrap();
+            serde_json::to_writer(file, &metadata).unwrap();
+        };
+
+        write_metadata(Some(13));
+        let nonce = read_vrf_nonce(tmp_dir.path()).unwrap();
+        assert_eq!(
+            VrfNonce {
+                index: 13,
+                label: vec![0x01, 0x02],
+            },
+            nonce
+        );
+        assert!(nonce.is_below(&[0x01, 0x03]));
+        assert!(!nonce.is_below(&[0x01, 0x02]));
+
+        write_metadata(None);
+        assert!(read_vrf_nonce(tmp_dir.path()).is_err());
+    }
+
     #[test]
     fn skip_non_pos_files() {
         let tmp_dir = tempdir().unwrap();
@@ -154,4 +1300,143 @@ mod tests {
 
         assert!(read_data(tmp_dir.path(), 4).next().is_none());
     }
+
+    #[test]
+    fn index_locations() {
+        let aligned = metadata(64);
+        assert_eq!((0, 0), index_to_location(0, &aligned));
+        assert_eq!((0, 48), index_to_location(3, &aligned));
+        assert_eq!((1, 0), index_to_location(4, &aligned));
+        assert_eq!((1, 16), index_to_location(5, &aligned));
+
+        // Blocks might span multiple files.
+        let unaligned = metadata(40);
+        assert_eq!((0, 32), index_to_location(2, &unaligned));
+        assert_eq!((1, 8), index_to_location(3, &unaligned));
+        assert_eq!((2, 0), index_to_location(5, &unaligned));
+    }
+
+    #[test]
+    fn reading_labels() {
+        let data = (0..128).collect::<Vec<u8>>();
+        for max_file_size in [16, 40, 64, 128] {
+            let tmp_dir = tempdir().unwrap();
+            for (i, chunk) in data.chunks(max_file_size).enumerate() {
+                let file_path = tmp_dir.path().join(format!("postdata_{i}.bin"));
+                File::create(file_path).unwrap().write_all(chunk).unwrap();
+            }
+            let metadata = metadata(max_file_size as u64);
+
+            let labels = read_labels(tmp_dir.path(), &metadata, &[0, 2, 3, 7]).unwrap();
+            for (label, index) in labels.iter().zip([0, 2, 3, 7]) {
+                assert_eq!(&data[index * 16..(index + 1) * 16], label);
+            }
+            assert!(read_labels(tmp_dir.path(), &metadata, &[8]).is_err());
+        }
+    }
+
+    fn write_metadata(datadir: &std::path::Path, commitment: &str) {
+        let metadata = serde_json::json!({
+            "NodeId": "",
+            "CommitmentAtxId": commitment,
+            "BitsPerLabel": 8,
+            "LabelsPerUnit": 12,
+            "NumUnits": 2,
+            "MaxFileSize": 12,
+        });
+        let file = File::create(datadir.join("postdata_metadata.json")).unwrap();
+        serde_json::to_writer(file, &metadata).unwrap();
+    }
+
+    fn read_to_string(batches: impl Iterator<Item = Batch>) -> String {
+        let mut result = String::new();
+        let mut next_expected_index = 0;
+        for batch in batches {
+            assert_eq!(next_expected_index, batch.index);
+            result.extend(std::str::from_utf8(&batch.data));
+            next_expected_index += batch.data.len() as u64;
+        }
+        result
+    }
+
+    #[test]
+    fn reading_mirrored_pos_data() {
+        let primary = tempdir().unwrap();
+        let mirror = tempdir().unwrap();
+        let data = ["Hello World!", "Welcome Back"];
+        for dir in [&primary, &mirror] {
+            write_metadata(dir.path(), "AAAA");
+            for (i, part) in data.iter().enumerate() {
+                let file_path = dir.path().join(format!("postdata_{i}.bin"));
+                write!(File::create(file_path).unwrap(), "{part}").unwrap();
+            }
+        }
+        // Make reading the primary files fail: a missing file and a directory.
+        std::fs::remove_file(primary.path().join("postdata_0.bin")).unwrap();
+        std::fs::remove_file(primary.path().join("postdata_1.bin")).unwrap();
+        std::fs::create_dir(primary.path().join("postdata_1.bin")).unwrap();
+
+        let dirs = [primary.path(), mirror.path()];
+        let batches = read_data_mirrored(&dirs, 5, OversizedFiles::Error).unwrap();
+        let batches = batches.collect::<std::io::Result<Vec<_>>>().unwrap();
+        assert_eq!(data.concat(), read_to_string(batches.into_iter()));
+
+        // Without a mirror, reading fails.
+        let mut batches = read_data_mirrored(&dirs[..1], 5, OversizedFiles::Error).unwrap();
+        assert!(batches.next().unwrap().is_err());
+        assert!(batches.next().is_none());
+    }
+
+    #[test]
+    fn reading_mirrored_files_of_other_sizes() {
+        let primary = tempdir().unwrap();
+        let mirror = tempdir().unwrap();
+        for dir in [&primary, &mirror] {
+            write_metadata(dir.path(), "AAAA");
+        }
+        // The primary copy of the first file is cut short, the mirror copy of the second
+        // one has leftovers.
+        std::fs::write(primary.path().join("postdata_0.bin"), "Hello").unwrap();
+        std::fs::write(mirror.path().join("postdata_0.bin"), "Hello World!").unwrap();
+        std::fs::write(primary.path().join("postdata_1.bin"), "Welcome Back").unwrap();
+        std::fs::write(mirror.path().join("postdata_1.bin"), "Welcome Back??").unwrap();
+
+        let dirs = [primary.path(), mirror.path()];
+        assert!(read_data_mirrored(&dirs, 5, OversizedFiles::Error).is_err());
+        let batches = read_data_mirrored(&dirs, 5, OversizedFiles::Truncate).unwrap();
+        let batches = batches.collect::<std::io::Result<Vec<_>>>().unwrap();
+        assert_eq!(
+            "Hello World!Welcome Back",
+            read_to_string(batches.into_iter())
+        );
+    }
+
+    #[test]
+    fn mirror_must_hold_same_data() {
+        let primary = tempdir().unwrap();
+        let mirror = tempdir().unwrap();
+        write_metadata(primary.path(), "AAAA");
+        write_metadata(mirror.path(), "BBBB");
+
+        assert!(
+            read_data_mirrored(&[primary.path(), mirror.path()], 5, OversizedFiles::Error).is_err()
+        );
+        assert!(read_data_mirrored(&[], 5, OversizedFiles::Error).is_err());
+    }
+
+    #[test]
+    fn loading_mirrored_metadata() {
+        let primary = tempdir().unwrap();
+        let mirror = tempdir().unwrap();
+        write_metadata(mirror.path(), "BBBB");
+
+        // The primary metadata is missing, then broken.
+        let dirs = [primary.path(), mirror.path()];
+        let expected = crate::metadata::load(mirror.path()).unwrap();
+        assert_eq!(expected, load_mirrored_metadata(&dirs).unwrap());
+        std::fs::write(primary.path().join("postdata_metadata.json"), "{").unwrap();
+        assert_eq!(expected, load_mirrored_metadata(&dirs).unwrap());
+
+        assert!(load_mirrored_metadata(&dirs[..1]).is_err());
+    }
 }
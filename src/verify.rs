@@ -1,35 +1,944 @@
-use aes::{
-    cipher::{BlockEncrypt, KeyInit},
-    Aes128,
+//! Verifying [proofs](crate::prove::Proof).
+//!
+//! [validate_proof_structure] performs the checks that don't need the POS data
+//! and should be used as a cheap gate before the full verification.
+//!
+//! [verify_with_labels] performs the full verification given the blocks of labels
+//! the proof points to.
+
+use std::{
+    collections::HashMap,
+    fmt,
+    sync::{Arc, Mutex},
+    time::{Duration, Instant},
+};
+
+use aes::cipher::BlockEncrypt;
+use cipher::generic_array::GenericArray;
+use rayon::{
+    prelude::{IndexedParallelIterator, IntoParallelRefIterator},
+    ThreadPool, ThreadPoolBuildError, ThreadPoolBuilder,
+};
+
+use crate::{
+    cipher::AesCipher,
+    compression::{compress_indexes, required_bits},
+    config::Config,
+    difficulty::proving_difficulty,
+    metadata::{PostMetadata, LABELS_BLOCK_SIZE},
+    pow::{hash_k2_pow, hash_k3_pow},
+    prove::{pow_scrypt_params, Proof},
 };
 
-pub struct Proof {
-    nonce: u64,
-    indices: [u64; 725],
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum StructureError {
+    /// The proof must contain exactly K2 indices.
+    InvalidIndicesCount { expected: u32, got: usize },
+    /// An index points past the end of the POS data.
+    IndexOutOfBounds { index: u64, max: u64 },
+    /// Indices must be strictly increasing, as that's the order the prover finds them in.
+    IndicesNotSorted { position: usize },
+}
+
+impl fmt::Display for StructureError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            StructureError::InvalidIndicesCount { expected, got } => {
+                write!(
+                    f,
+                    "invalid number of indices: expected {expected}, got {got}"
+                )
+            }
+            StructureError::IndexOutOfBounds { index, max } => {
+                write!(f, "index {index} out of bounds (max: {max})")
+            }
+            StructureError::IndicesNotSorted { position } => {
+                write!(
+                    f,
+                    "indices are not strictly increasing at position {position}"
+                )
+            }
+        }
+    }
+}
+
+impl std::error::Error for StructureError {}
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum VerifyError {
+    InvalidStructure(StructureError),
+    /// The config doesn't allow to derive the proving difficulty.
+    InvalidConfig(String),
+    /// A block of labels must be given for every index of the proof.
+    LabelsCountMismatch {
+        expected: usize,
+        got: usize,
+    },
+    InvalidK2Pow,
+    InvalidK3Pow,
+    /// The labels at the index don't satisfy the proving difficulty.
+    InvalidLabels {
+        index: u64,
+    },
+    /// The verification took longer than [VerifyConfig::max_duration].
+    Timeout,
+}
+
+impl From<StructureError> for VerifyError {
+    fn from(err: StructureError) -> Self {
+        VerifyError::InvalidStructure(err)
+    }
+}
+
+impl fmt::Display for VerifyError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            VerifyError::InvalidStructure(err) => write!(f, "invalid proof structure: {err}"),
+            VerifyError::InvalidConfig(msg) => write!(f, "invalid config: {msg}"),
+            VerifyError::LabelsCountMismatch { expected, got } => {
+                write!(f, "expected labels for {expected} indices, got {got}")
+            }
+            VerifyError::InvalidK2Pow => write!(f, "invalid k2 pow"),
+            VerifyError::InvalidK3Pow => write!(f, "invalid k3 pow"),
+            VerifyError::InvalidLabels { index } => {
+                write!(f, "labels at index {index} don't satisfy the difficulty")
+            }
+            VerifyError::Timeout => write!(f, "verification timed out"),
+        }
+    }
+}
+
+impl std::error::Error for VerifyError {}
+
+/// Check the parts of a proof that don't depend on the POS data.
+pub fn validate_proof_structure(
+    proof: &Proof,
+    metadata: &PostMetadata,
+    cfg: &Config,
+) -> Result<(), StructureError> {
+    if proof.indicies.len() != cfg.k2 as usize {
+        return Err(StructureError::InvalidIndicesCount {
+            expected: cfg.k2,
+            got: proof.indicies.len(),
+        });
+    }
+
+    let max = metadata.num_label_blocks();
+    if let Some(&index) = proof.indicies.iter().find(|&&index| index >= max) {
+        return Err(StructureError::IndexOutOfBounds { index, max });
+    }
+
+    if let Some(position) = proof.indicies.windows(2).position(|w| w[0] >= w[1]) {
+        return Err(StructureError::IndicesNotSorted {
+            position: position + 1,
+        });
+    }
+
+    Ok(())
+}
+
+/// Difficulty the labels at every index of a proof must satisfy.
+fn labels_difficulty(metadata: &PostMetadata, cfg: &Config) -> Result<u64, VerifyError> {
+    let num_labels = metadata.num_units as u64 * metadata.labels_per_unit;
+    proving_difficulty(num_labels, cfg.b, cfg.k1)
+        .map_err(|e| VerifyError::InvalidConfig(e.to_string()))
+}
+
+/// Encrypt a block of labels and pick the value for the nonce,
+/// the same way the prover does.
+fn label_value(cipher: &AesCipher, nonce: u32, block: &[u8; LABELS_BLOCK_SIZE]) -> u64 {
+    let mut output = GenericArray::from([0u8; LABELS_BLOCK_SIZE]);
+    cipher
+        .aes
+        .encrypt_block_b2b(GenericArray::from_slice(block.as_slice()), &mut output);
+    // Every AES output block holds values for 2 nonces.
+    let offset = (nonce % 2) as usize * 8;
+    u64::from_le_bytes(output[offset..offset + 8].try_into().unwrap())
+}
+
+/// Options of the verification itself, independent of the proving [Config].
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct VerifyConfig {
+    /// Number of threads checking the labels of a single proof.
+    pub threads: usize,
+    /// Minimal number of indices in a proof to check its labels on multiple threads.
+    /// For smaller proofs spawning the threads costs more than it saves.
+    pub parallel_threshold: usize,
+    /// Check the labels against this difficulty instead of the one derived from the [Config],
+    /// to test the boundaries of the difficulty. Only exists in tests.
+    #[cfg(test)]
+    pub(crate) difficulty: Option<u64>,
+    /// Abort the verification with [VerifyError::Timeout] once it takes longer than this.
+    /// It's checked between the indices, so the verification can overrun it
+    /// by the time it takes to check a few of them.
+    pub max_duration: Option<Duration>,
+}
+
+/// Number of indices checked between looking at the deadline.
+const DEADLINE_CHECK_INTERVAL: usize = 64;
+
+fn past_deadline(deadline: Option<Instant>) -> bool {
+    deadline.map_or(false, |deadline| Instant::now() >= deadline)
+}
+
+impl VerifyConfig {
+    /// Difficulty to check the labels against, unless a test overrides it.
+    fn difficulty_for(&self, metadata: &PostMetadata, cfg: &Config) -> Result<u64, VerifyError> {
+        #[cfg(test)]
+        if let Some(difficulty) = self.difficulty {
+            return Ok(difficulty);
+        }
+        labels_difficulty(metadata, cfg)
+    }
+}
+
+impl Default for VerifyConfig {
+    fn default() -> Self {
+        Self {
+            threads: 1,
+            parallel_threshold: 2048,
+            #[cfg(test)]
+            difficulty: None,
+            max_duration: None,
+        }
+    }
+}
+
+/// Time spent in the phases of a verification.
+#[derive(Debug, Default, Clone, PartialEq, Eq)]
+pub struct VerifyTimings {
+    /// Checking the k2 and k3 proofs of work.
+    pub pow: Duration,
+    /// Deriving the AES cipher for the nonce.
+    pub cipher_setup: Duration,
+    /// Checking the labels at all indices.
+    pub labels: Duration,
+}
+
+/// Run `f`, adding the time it took to `elapsed` if given.
+fn timed<T>(elapsed: Option<&mut Duration>, f: impl FnOnce() -> T) -> T {
+    match elapsed {
+        Some(elapsed) => {
+            let start = Instant::now();
+            let result = f();
+            *elapsed += start.elapsed();
+            result
+        }
+        None => f(),
+    }
+}
+
+/// Verify a proof given the labels it points to.
+///
+/// `labels` must contain the block of labels for every index of the proof, in the same order.
+/// The POS data is not accessed.
+pub fn verify_with_labels(
+    challenge: &[u8; 32],
+    proof: &Proof,
+    metadata: &PostMetadata,
+    cfg: &Config,
+    labels: &[[u8; LABELS_BLOCK_SIZE]],
+    verify_cfg: &VerifyConfig,
+) -> Result<(), VerifyError> {
+    verify_with_labels_impl(challenge, proof, metadata, cfg, labels, verify_cfg, None)
+}
+
+/// Same as [verify_with_labels] but also measures the time spent in each phase
+/// of the verification, to find its hotspots.
+pub fn verify_with_labels_timed(
+    challenge: &[u8; 32],
+    proof: &Proof,
+    metadata: &PostMetadata,
+    cfg: &Config,
+    labels: &[[u8; LABELS_BLOCK_SIZE]],
+    verify_cfg: &VerifyConfig,
+) -> (Result<(), VerifyError>, VerifyTimings) {
+    let mut timings = VerifyTimings::default();
+    let result = verify_with_labels_impl(
+        challenge,
+        proof,
+        metadata,
+        cfg,
+        labels,
+        verify_cfg,
+        Some(&mut timings),
+    );
+    (result, timings)
+}
+
+fn verify_with_labels_impl(
+    challenge: &[u8; 32],
+    proof: &Proof,
+    metadata: &PostMetadata,
+    cfg: &Config,
+    labels: &[[u8; LABELS_BLOCK_SIZE]],
+    verify_cfg: &VerifyConfig,
+    mut timings: Option<&mut VerifyTimings>,
+) -> Result<(), VerifyError> {
+    validate_proof_structure(proof, metadata, cfg)?;
+    if labels.len() != proof.indicies.len() {
+        return Err(VerifyError::LabelsCountMismatch {
+            expected: proof.indicies.len(),
+            got: labels.len(),
+        });
+    }
+
+    let difficulty = verify_cfg.difficulty_for(metadata, cfg)?;
+    let deadline = verify_cfg.max_duration.map(|d| Instant::now() + d);
+
+    timed(timings.as_mut().map(|t| &mut t.pow), || {
+        verify_pows(challenge, proof, metadata, cfg)
+    })?;
+    if past_deadline(deadline) {
+        return Err(VerifyError::Timeout);
+    }
+    let cipher = timed(timings.as_mut().map(|t| &mut t.cipher_setup), || {
+        AesCipher::with_k2_pow(challenge, proof.nonce / 2, proof.k2_pow)
+    });
+    timed(timings.as_mut().map(|t| &mut t.labels), || {
+        verify_labels(&cipher, proof, labels, difficulty, verify_cfg, deadline)
+    })
+}
+
+fn verify_pows(
+    challenge: &[u8; 32],
+    proof: &Proof,
+    metadata: &PostMetadata,
+    cfg: &Config,
+) -> Result<(), VerifyError> {
+    verify_k2_pow(challenge, proof, cfg)?;
+    verify_k3_pow(challenge, proof, metadata, cfg)
+}
+
+fn verify_k2_pow(challenge: &[u8; 32], proof: &Proof, cfg: &Config) -> Result<(), VerifyError> {
+    let scrypt = pow_scrypt_params();
+    if hash_k2_pow(challenge, proof.nonce / 2, scrypt, proof.k2_pow) >= cfg.k2_pow_difficulty {
+        return Err(VerifyError::InvalidK2Pow);
+    }
+    Ok(())
+}
+
+fn verify_k3_pow(
+    challenge: &[u8; 32],
+    proof: &Proof,
+    metadata: &PostMetadata,
+    cfg: &Config,
+) -> Result<(), VerifyError> {
+    let scrypt = pow_scrypt_params();
+    let bits = required_bits(metadata.num_label_blocks());
+    let compressed_indexes = compress_indexes(&proof.indicies, bits);
+    let k3_hash = hash_k3_pow(
+        challenge,
+        proof.nonce,
+        &compressed_indexes,
+        scrypt,
+        proof.k2_pow,
+        proof.k3_pow,
+    );
+    if k3_hash >= cfg.k3_pow_difficulty {
+        return Err(VerifyError::InvalidK3Pow);
+    }
+    Ok(())
+}
+
+/// Thread pool checking labels, with its number of threads.
+/// Building a pool costs more than checking the labels of a proof, so it's shared
+/// by all verifications. Only the pool for the last number of threads asked for is kept,
+/// verifications still running on a replaced pool keep it alive until they finish.
+static THREAD_POOL: Mutex<Option<(usize, Arc<ThreadPool>)>> = Mutex::new(None);
+
+fn thread_pool(threads: usize) -> Result<Arc<ThreadPool>, ThreadPoolBuildError> {
+    let mut cached = THREAD_POOL.lock().unwrap_or_else(|e| e.into_inner());
+    match &*cached {
+        Some((n, pool)) if *n == threads => Ok(pool.clone()),
+        _ => {
+            let pool = Arc::new(ThreadPoolBuilder::new().num_threads(threads).build()?);
+            *cached = Some((threads, pool.clone()));
+            Ok(pool)
+        }
+    }
+}
+
+fn verify_labels(
+    cipher: &AesCipher,
+    proof: &Proof,
+    labels: &[[u8; LABELS_BLOCK_SIZE]],
+    difficulty: u64,
+    verify_cfg: &VerifyConfig,
+    deadline: Option<Instant>,
+) -> Result<(), VerifyError> {
+    let invalid =
+        |block: &[u8; LABELS_BLOCK_SIZE]| label_value(cipher, proof.nonce, block) > difficulty;
+    // Stop at an invalid index or once past the deadline, told apart below.
+    let stop = |(i, block): (usize, &[u8; LABELS_BLOCK_SIZE])| {
+        (i % DEADLINE_CHECK_INTERVAL == 0 && past_deadline(deadline)) || invalid(block)
+    };
+
+    let position = if verify_cfg.threads > 1 && labels.len() >= verify_cfg.parallel_threshold {
+        match thread_pool(verify_cfg.threads) {
+            // Report the first invalid index regardless of which thread finds it.
+            Ok(pool) => pool.install(|| labels.par_iter().enumerate().position_first(stop)),
+            Err(e) => {
+                log::warn!("failed to build a thread pool, verifying on one thread: {e}");
+                labels.iter().enumerate().position(stop)
+            }
+        }
+    } else {
+        labels.iter().enumerate().position(stop)
+    };
+
+    match position {
+        Some(position) if invalid(&labels[position]) => Err(VerifyError::InvalidLabels {
+            index: proof.indicies[position],
+        }),
+        Some(_) => Err(VerifyError::Timeout),
+        None => Ok(()),
+    }
 }
 
-fn work_oracle(_i: u64) -> u8 {
-    0
+/// Verify multiple proofs for the same challenge and POS data.
+///
+/// `proofs` holds every proof along with the labels it points to, as for [verify_with_labels].
+/// Every proof gets its own result, in the same order. The work that doesn't depend on
+/// the indices is done once for all proofs: deriving the difficulty and, for proofs sharing
+/// the nonce group and k2 pow, checking the k2 pow and deriving the AES cipher.
+///
+/// [VerifyConfig::max_duration] applies to the whole batch, the proofs
+/// not verified before it passes fail with [VerifyError::Timeout].
+pub fn verify_batch(
+    challenge: &[u8; 32],
+    proofs: &[(&Proof, &[[u8; LABELS_BLOCK_SIZE]])],
+    metadata: &PostMetadata,
+    cfg: &Config,
+    verify_cfg: &VerifyConfig,
+) -> Vec<Result<(), VerifyError>> {
+    let difficulty = match verify_cfg.difficulty_for(metadata, cfg) {
+        Ok(difficulty) => difficulty,
+        Err(err) => return vec![Err(err); proofs.len()],
+    };
+    let deadline = verify_cfg.max_duration.map(|d| Instant::now() + d);
+
+    // Keyed by the nonce group and the k2 pow.
+    let mut k2_pows = HashMap::<(u32, u64), Result<(), VerifyError>>::new();
+    let mut ciphers = HashMap::<(u32, u64), AesCipher>::new();
+    proofs
+        .iter()
+        .map(|&(proof, labels)| {
+            if past_deadline(deadline) {
+                return Err(VerifyError::Timeout);
+            }
+            validate_proof_structure(proof, metadata, cfg)?;
+            if labels.len() != proof.indicies.len() {
+                return Err(VerifyError::LabelsCountMismatch {
+                    expected: proof.indicies.len(),
+                    got: labels.len(),
+                });
+            }
+
+            let key = (proof.nonce / 2, proof.k2_pow);
+            k2_pows
+                .entry(key)
+                .or_insert_with(|| verify_k2_pow(challenge, proof, cfg))
+                .clone()?;
+            verify_k3_pow(challenge, proof, metadata, cfg)?;
+            let cipher = ciphers
+                .entry(key)
+                .or_insert_with(|| AesCipher::with_k2_pow(challenge, key.0, key.1));
+            verify_labels(cipher, proof, labels, difficulty, verify_cfg, deadline)
+        })
+        .collect()
 }
 
-pub fn verify(challenge: &[u8; 16], d: u64, proof: &Proof) -> bool {
-    let mut key = [0u8; 16];
-    key[..12].copy_from_slice(&challenge[..12]);
-    key[12..].copy_from_slice(&proof.nonce.to_le_bytes());
-    let cipher = Aes128::new(&key.into());
+/// Result of checking the labels at a single index of a proof.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct IndexResult {
+    pub index: u64,
+    /// Value computed from the labels, compared against the difficulty.
+    pub value: u64,
+    /// The highest value that passes.
+    pub difficulty: u64,
+    pub passed: bool,
+}
 
-    let mut output = [0u8; 16];
-    let output_index = proof.nonce as usize % 2;
+/// Check the labels at every index of a proof, without stopping at the first failure.
+///
+/// This is a debugging aid, use [verify_with_labels] to verify proofs. The proofs of work
+/// and the structure of the proof are not checked. The options of `verify_cfg`
+/// are ignored.
+pub fn verify_report_all(
+    challenge: &[u8; 32],
+    proof: &Proof,
+    metadata: &PostMetadata,
+    cfg: &Config,
+    labels: &[[u8; LABELS_BLOCK_SIZE]],
+    verify_cfg: &VerifyConfig,
+) -> Result<Vec<IndexResult>, VerifyError> {
+    if labels.len() != proof.indicies.len() {
+        return Err(VerifyError::LabelsCountMismatch {
+            expected: proof.indicies.len(),
+            got: labels.len(),
+        });
+    }
+    let difficulty = verify_cfg.difficulty_for(metadata, cfg)?;
 
-    for i in proof.indices.into_iter() {
-        let labels = (i..i + 16).map(|i| work_oracle(i)).collect();
-        cipher.encrypt_block_b2b(&labels, (&mut output).into());
-        unsafe {
-            let (_, ints, _) = output.align_to::<u64>();
-            if ints[output_index].to_le() > d {
-                return false;
+    let cipher = AesCipher::with_k2_pow(challenge, proof.nonce / 2, proof.k2_pow);
+    Ok(proof
+        .indicies
+        .iter()
+        .zip(labels)
+        .map(|(&index, block)| {
+            let value = label_value(&cipher, proof.nonce, block);
+            IndexResult {
+                index,
+                value,
+                difficulty,
+                passed: value <= difficulty,
             }
+        })
+        .collect())
+}
+
+/// Compute the value of the labels at every index of a proof the same way the verification
+/// does, without comparing it against the difficulty.
+///
+/// Meant for comparing the verifier against other implementations, e.g. when fuzzing.
+/// Nothing but the number of labels is checked.
+pub fn compute_label_values(
+    challenge: &[u8; 32],
+    proof: &Proof,
+    labels: &[[u8; LABELS_BLOCK_SIZE]],
+) -> Result<Vec<u64>, VerifyError> {
+    if labels.len() != proof.indicies.len() {
+        return Err(VerifyError::LabelsCountMismatch {
+            expected: proof.indicies.len(),
+            got: labels.len(),
+        });
+    }
+    let cipher = AesCipher::with_k2_pow(challenge, proof.nonce / 2, proof.k2_pow);
+    Ok(labels
+        .iter()
+        .map(|block| label_value(&cipher, proof.nonce, block))
+        .collect())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{
+        bundle::{read_bundle, IndexEncoding},
+        prove::{
+            generate_proof,
+            tests::{labels_for, pos_data, proving_config},
+        },
+    };
+
+    fn metadata() -> PostMetadata {
+        PostMetadata {
+            node_id: vec![0; 32],
+            commitment_atx_id: vec![0; 32],
+            bits_per_label: 8,
+            labels_per_unit: 1024,
+            num_units: 2,
+            max_file_size: 1024,
+            nonce: None,
+            last_position: None,
+            checksums: None,
+        }
+    }
+
+    fn config() -> Config {
+        Config {
+            labels_per_unit: 1024,
+            k1: 4,
+            k2: 4,
+            k2_pow_difficulty: u64::MAX,
+            k3_pow_difficulty: u64::MAX,
+            b: 16,
+            n: 2,
+            ..Config::default()
+        }
+    }
+
+    fn proof(indicies: Vec<u64>) -> Proof {
+        Proof {
+            nonce: 0,
+            indicies,
+            k2_pow: 0,
+            k3_pow: 0,
+        }
+    }
+
+    #[test]
+    fn valid_structure() {
+        let proof = proof(vec![0, 1, 50, 127]);
+        assert_eq!(
+            Ok(()),
+            validate_proof_structure(&proof, &metadata(), &config())
+        );
+    }
+
+    #[test]
+    fn invalid_indices_count() {
+        let proof = proof(vec![0, 1, 2]);
+        assert_eq!(
+            Err(StructureError::InvalidIndicesCount {
+                expected: 4,
+                got: 3
+            }),
+            validate_proof_structure(&proof, &metadata(), &config())
+        );
+    }
+
+    #[test]
+    fn index_out_of_bounds() {
+        let proof = proof(vec![0, 1, 2, 128]);
+        assert_eq!(
+            Err(StructureError::IndexOutOfBounds {
+                index: 128,
+                max: 128
+            }),
+            validate_proof_structure(&proof, &metadata(), &config())
+        );
+    }
+
+    #[test]
+    fn indices_not_sorted() {
+        let unsorted = proof(vec![0, 2, 1, 3]);
+        assert_eq!(
+            Err(StructureError::IndicesNotSorted { position: 2 }),
+            validate_proof_structure(&unsorted, &metadata(), &config())
+        );
+
+        let duplicated = proof(vec![0, 1, 1, 3]);
+        assert_eq!(
+            Err(StructureError::IndicesNotSorted { position: 2 }),
+            validate_proof_structure(&duplicated, &metadata(), &config())
+        );
+    }
+
+    #[test]
+    fn difficulty_boundary() {
+        let challenge = b"hello world, CHALLENGE me!!!!!!!";
+        let proof = proof(vec![0, 1, 50, 127]);
+        let labels = [[1u8; 16], [2; 16], [3; 16], [4; 16]];
+        let cipher = AesCipher::with_k2_pow(challenge, proof.nonce / 2, proof.k2_pow);
+        let highest = labels
+            .iter()
+            .map(|block| label_value(&cipher, proof.nonce, block))
+            .max()
+            .unwrap();
+        let position = labels
+            .iter()
+            .position(|block| label_value(&cipher, proof.nonce, block) == highest)
+            .unwrap();
+
+        let at_boundary = VerifyConfig {
+            difficulty: Some(highest),
+            ..VerifyConfig::default()
+        };
+        assert_eq!(
+            Ok(()),
+            verify_with_labels(
+                challenge,
+                &proof,
+                &metadata(),
+                &config(),
+                &labels,
+                &at_boundary
+            )
+        );
+
+        let below_boundary = VerifyConfig {
+            difficulty: Some(highest - 1),
+            ..VerifyConfig::default()
+        };
+        assert_eq!(
+            Err(VerifyError::InvalidLabels {
+                index: proof.indicies[position]
+            }),
+            verify_with_labels(
+                challenge,
+                &proof,
+                &metadata(),
+                &config(),
+                &labels,
+                &below_boundary
+            )
+        );
+    }
+
+    #[test]
+    fn verification_deadline() {
+        let challenge = b"hello world, CHALLENGE me!!!!!!!";
+        let proof = proof(vec![0, 1, 50, 127]);
+        let labels = [[0u8; 16]; 4];
+        let verify_cfg = VerifyConfig {
+            difficulty: Some(u64::MAX),
+            max_duration: Some(Duration::ZERO),
+            ..VerifyConfig::default()
+        };
+        let verify = |verify_cfg| {
+            verify_with_labels(
+                challenge,
+                &proof,
+                &metadata(),
+                &config(),
+                &labels,
+                verify_cfg,
+            )
+        };
+        assert_eq!(Err(VerifyError::Timeout), verify(&verify_cfg));
+
+        let verify_cfg = VerifyConfig {
+            max_duration: Some(Duration::from_secs(3600)),
+            ..verify_cfg
+        };
+        assert_eq!(Ok(()), verify(&verify_cfg));
+    }
+
+    #[test]
+    fn verify_proof_from_bundle() {
+        let challenge = b"hello world, CHALLENGE me!!!!!!!";
+        let (datadir, data, metadata) = pos_data(512 * 1024);
+
+        let proof = generate_proof(datadir.path(), challenge, proving_config()).unwrap();
+        let cfg = proving_config();
+        let path = datadir.path().join("proof.bundle");
+        for encoding in [IndexEncoding::FixedWidth, IndexEncoding::Varint] {
+            proof
+                .write_bundle_with_encoding(&path, &metadata, encoding)
+                .unwrap();
+            let (read_proof, read_metadata) = read_bundle(&path).unwrap();
+            let labels = labels_for(&data, &read_proof);
+            assert_eq!(
+                Ok(()),
+                verify_with_labels(
+                    challenge,
+                    &read_proof,
+                    &read_metadata,
+                    &cfg,
+                    &labels,
+                    &VerifyConfig::default()
+                )
+            );
+        }
+    }
+
+    #[test]
+    fn verify_generated_proof() {
+        let challenge = b"hello world, CHALLENGE me!!!!!!!";
+        let (datadir, data, metadata) = pos_data(512 * 1024);
+
+        let proof = generate_proof(datadir.path(), challenge, proving_config()).unwrap();
+        let mut labels = labels_for(&data, &proof);
+        let cfg = proving_config();
+        assert_eq!(
+            Ok(()),
+            verify_with_labels(
+                challenge,
+                &proof,
+                &metadata,
+                &cfg,
+                &labels,
+                &VerifyConfig::default()
+            )
+        );
+        let (result, timings) = verify_with_labels_timed(
+            challenge,
+            &proof,
+            &metadata,
+            &cfg,
+            &labels,
+            &VerifyConfig::default(),
+        );
+        assert_eq!(Ok(()), result);
+        assert!(timings.pow > Duration::ZERO);
+
+        let cfg = Config {
+            k2_pow_difficulty: 0,
+            ..proving_config()
+        };
+        assert_eq!(
+            Err(VerifyError::InvalidK2Pow),
+            verify_with_labels(
+                challenge,
+                &proof,
+                &metadata,
+                &cfg,
+                &labels,
+                &VerifyConfig::default()
+            )
+        );
+
+        let cfg = Config {
+            k3_pow_difficulty: 0,
+            ..proving_config()
+        };
+        assert_eq!(
+            Err(VerifyError::InvalidK3Pow),
+            verify_with_labels(
+                challenge,
+                &proof,
+                &metadata,
+                &cfg,
+                &labels,
+                &VerifyConfig::default()
+            )
+        );
+
+        let cfg = proving_config();
+        assert_eq!(
+            Err(VerifyError::LabelsCountMismatch {
+                expected: 50,
+                got: 49
+            }),
+            verify_with_labels(
+                challenge,
+                &proof,
+                &metadata,
+                &cfg,
+                &labels[1..],
+                &VerifyConfig::default()
+            )
+        );
+
+        // Labels not satisfying the difficulty.
+        let cipher = AesCipher::with_k2_pow(challenge, proof.nonce / 2, proof.k2_pow);
+        let num_labels = metadata.num_units as u64 * metadata.labels_per_unit;
+        let difficulty = proving_difficulty(num_labels, cfg.b, cfg.k1).unwrap();
+        labels[7] = (0..=u8::MAX)
+            .map(|b| [b; 16])
+            .find(|block| label_value(&cipher, proof.nonce, block) > difficulty)
+            .unwrap();
+        assert_eq!(
+            Err(VerifyError::InvalidLabels {
+                index: proof.indicies[7]
+            }),
+            verify_with_labels(
+                challenge,
+                &proof,
+                &metadata,
+                &cfg,
+                &labels,
+                &VerifyConfig::default()
+            )
+        );
+
+        // The same index is reported when checking on multiple threads.
+        let parallel = VerifyConfig {
+            threads: 4,
+            parallel_threshold: 1,
+            ..VerifyConfig::default()
+        };
+        labels[20] = labels[7];
+        assert_eq!(
+            Err(VerifyError::InvalidLabels {
+                index: proof.indicies[7]
+            }),
+            verify_with_labels(challenge, &proof, &metadata, &cfg, &labels, &parallel)
+        );
+        // The thread pool is built once and reused, until another number of threads is needed.
+        let pool = thread_pool(4).unwrap();
+        assert!(Arc::ptr_eq(&pool, &thread_pool(4).unwrap()));
+        assert_eq!(2, thread_pool(2).unwrap().current_num_threads());
+        assert!(!Arc::ptr_eq(&pool, &thread_pool(4).unwrap()));
+
+        // All invalid indices are reported.
+        let report = verify_report_all(
+            challenge,
+            &proof,
+            &metadata,
+            &cfg,
+            &labels,
+            &VerifyConfig::default(),
+        )
+        .unwrap();
+        assert_eq!(proof.indicies.len(), report.len());
+        for (result, &index) in report.iter().zip(&proof.indicies) {
+            assert_eq!(index, result.index);
+            assert_eq!(difficulty, result.difficulty);
+            assert_eq!(result.value <= difficulty, result.passed);
+        }
+        let failed = report
+            .iter()
+            .filter(|r| !r.passed)
+            .map(|r| r.index)
+            .collect::<Vec<_>>();
+        assert_eq!(vec![proof.indicies[7], proof.indicies[20]], failed);
+
+        // The difficulty override applies to the report too.
+        let verify_cfg = VerifyConfig {
+            difficulty: Some(u64::MAX),
+            ..VerifyConfig::default()
+        };
+        let overridden =
+            verify_report_all(challenge, &proof, &metadata, &cfg, &labels, &verify_cfg).unwrap();
+        assert!(overridden
+            .iter()
+            .all(|r| r.passed && r.difficulty == u64::MAX));
+
+        // The same values are computed without checking them.
+        assert_eq!(
+            report.iter().map(|r| r.value).collect::<Vec<_>>(),
+            compute_label_values(challenge, &proof, &labels).unwrap()
+        );
+        assert_eq!(
+            Err(VerifyError::LabelsCountMismatch {
+                expected: proof.indicies.len(),
+                got: 1,
+            }),
+            compute_label_values(challenge, &proof, &labels[..1])
+        );
+    }
+
+    #[test]
+    fn verify_proofs_in_batch() {
+        let challenge = b"hello world, CHALLENGE me!!!!!!!";
+        let (datadir, data, metadata) = pos_data(512 * 1024);
+
+        let proof = generate_proof(datadir.path(), challenge, proving_config()).unwrap();
+        let cfg = proving_config();
+        let labels = labels_for(&data, &proof);
+
+        let cipher = AesCipher::with_k2_pow(challenge, proof.nonce / 2, proof.k2_pow);
+        let difficulty = labels_difficulty(&metadata, &cfg).unwrap();
+        let mut invalid_labels = labels.clone();
+        invalid_labels[3] = (0..=u8::MAX)
+            .map(|b| [b; 16])
+            .find(|block| label_value(&cipher, proof.nonce, block) > difficulty)
+            .unwrap();
+
+        let batch: Vec<(&Proof, &[[u8; 16]])> = vec![
+            (&proof, &labels[..]),
+            (&proof, &invalid_labels[..]),
+            (&proof, &labels[..]),
+            (&proof, &labels[1..]),
+        ];
+        let results = verify_batch(challenge, &batch, &metadata, &cfg, &VerifyConfig::default());
+        assert_eq!(
+            vec![
+                Ok(()),
+                Err(VerifyError::InvalidLabels {
+                    index: proof.indicies[3]
+                }),
+                Ok(()),
+                Err(VerifyError::LabelsCountMismatch {
+                    expected: 50,
+                    got: 49
+                }),
+            ],
+            results
+        );
+        for ((proof, labels), result) in batch.iter().zip(results) {
+            let single = verify_with_labels(
+                challenge,
+                proof,
+                &metadata,
+                &cfg,
+                labels,
+                &VerifyConfig::default(),
+            );
+            assert_eq!(single, result);
         }
     }
-    true
 }